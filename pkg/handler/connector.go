@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,40 @@ import (
 	"github.com/discovertomorrow/progai-middleware/pkg/logging"
 )
 
+// ErrWriteResponse is returned by [RequestBackend] if yield stopped the
+// response, e.g. because the client went away. It is not a backend failure.
+var ErrWriteResponse = errors.New("writing response")
+
+// maxErrorBody limits the body kept by a [StatusError].
+const maxErrorBody = 4096
+
+// StatusError is returned by [RequestBackend] if the backend responded with
+// a status other than 2xx, e.g. 503 while llama.cpp loads the model.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("backend responded with status %d: %s", e.StatusCode, e.Body)
+}
+
+// WriteBackendError answers a request whose backend call failed with err.
+// Client errors of the backend are passed on, other failures are answered
+// with 502, or 503 if the backend is unavailable.
+func WriteBackendError(w http.ResponseWriter, err error) {
+	var status *StatusError
+	if errors.As(err, &status) && status.StatusCode < 500 {
+		http.Error(w, status.Body, status.StatusCode)
+		return
+	}
+	if errors.As(err, &status) && status.StatusCode == http.StatusServiceUnavailable {
+		http.Error(w, "backend unavailable, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Error requesting response", http.StatusBadGateway)
+}
+
 func RequestBackend(
 	req *http.Request,
 	yield func([]byte) bool,
@@ -23,11 +58,17 @@ func RequestBackend(
 	l.Info("Sending request to backend")
 	resp, err := client.Do(req)
 	if err != nil {
-		l.Error("Error sending request", err)
+		l.Error("Error sending request", "error", err)
 		return fmt.Errorf("sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		l.Error("Backend responded with error", "status", resp.StatusCode, "body", string(body))
+		return &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
 	if lineByLine {
 		reader := bufio.NewReader(resp.Body)
 		for {
@@ -36,16 +77,16 @@ func RequestBackend(
 				if err == io.EOF {
 					if len(line) > 0 {
 						if !yield(line) {
-							return fmt.Errorf("writing response")
+							return ErrWriteResponse
 						}
 					}
 					break // End of file
 				}
-				l.Error("Error reading response", err)
+				l.Error("Error reading response", "error", err)
 				return fmt.Errorf("reading response: %w", err)
 			}
 			if !yield(line) {
-				return fmt.Errorf("writing response")
+				return ErrWriteResponse
 			}
 			if err != nil && err == io.EOF {
 				break // End of file
@@ -54,11 +95,11 @@ func RequestBackend(
 	} else {
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			l.Error("Error reading body", err)
+			l.Error("Error reading body", "error", err)
 			return fmt.Errorf("reading body: %w", err)
 		}
 		if !yield(body) {
-			return fmt.Errorf("writing body")
+			return fmt.Errorf("writing body: %w", ErrWriteResponse)
 		}
 	}
 	return nil
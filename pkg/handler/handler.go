@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"context"
 	"net/http"
+	"sync"
 
 	"github.com/discovertomorrow/progai-middleware/pkg/logging"
 )
@@ -15,22 +17,112 @@ type Endpoint struct {
 // allowed.
 //
 // This function returns a middleware function that wraps around an
-// http.Handler.
+// http.Handler. Use [NewConcurrencyLimiter] to be able to drain it.
 func Limiter(concurrent int) func(http.Handler) http.Handler {
-	semaphore := make(chan struct{}, concurrent)
-
-	return func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := r.Context()
-			semaphore <- struct{}{}
-			defer func() {
-				<-semaphore
-			}()
-			h.ServeHTTP(w, r.WithContext(ctx))
-		})
+	return NewConcurrencyLimiter(concurrent).Middleware
+}
+
+// drainRetryAfter is sent as Retry-After (seconds) to requests rejected while
+// draining.
+const drainRetryAfter = "5"
+
+// ConcurrencyLimiter limits the number of concurrent requests and can be
+// drained for a graceful shutdown.
+type ConcurrencyLimiter struct {
+	semaphore chan struct{}
+	mutex     sync.Mutex
+	active    int
+	// finished is closed and replaced whenever a request finishes
+	finished  chan struct{}
+	draining  chan struct{}
+	drainOnce sync.Once
+}
+
+// NewConcurrencyLimiter creates a [ConcurrencyLimiter] allowing concurrent
+// requests.
+func NewConcurrencyLimiter(concurrent int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		semaphore: make(chan struct{}, concurrent),
+		finished:  make(chan struct{}),
+		draining:  make(chan struct{}),
+	}
+}
+
+// Middleware wraps h, so it is only called by a limited number of concurrent
+// requests. Requests arriving or waiting during a drain are answered with 503
+// and Retry-After.
+func (cl *ConcurrencyLimiter) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		select {
+		case <-cl.draining:
+			writeDraining(w)
+			return
+		default:
+		}
+		cl.mutex.Lock()
+		cl.active++
+		cl.mutex.Unlock()
+		defer cl.finish()
+
+		select {
+		case cl.semaphore <- struct{}{}:
+		case <-cl.draining:
+			writeDraining(w)
+			return
+		case <-ctx.Done():
+			return
+		}
+		defer func() {
+			<-cl.semaphore
+		}()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Drain rejects new requests and waits until running requests are finished
+// or ctx is done.
+//
+// To shut down gracefully, drain before shutting down the server, so
+// streaming responses are not cut off:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+//	defer cancel()
+//	limiter.Drain(ctx)
+//	server.Shutdown(ctx)
+func (cl *ConcurrencyLimiter) Drain(ctx context.Context) error {
+	cl.drainOnce.Do(func() {
+		close(cl.draining)
+	})
+	for {
+		cl.mutex.Lock()
+		active := cl.active
+		finished := cl.finished
+		cl.mutex.Unlock()
+		if active == 0 {
+			return nil
+		}
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
+func (cl *ConcurrencyLimiter) finish() {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.active--
+	close(cl.finished)
+	cl.finished = make(chan struct{})
+}
+
+func writeDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", drainRetryAfter)
+	http.Error(w, "server is shutting down, try again later", http.StatusServiceUnavailable)
+}
+
 func NewDefaultHandler(
 	lineByLine bool,
 	endpoint Endpoint,
@@ -50,18 +142,18 @@ func NewDefaultHandler(
 
 		req, err := http.NewRequestWithContext(ctx, "POST", endpoint.Endpoint, r.Body)
 		if err != nil {
-			l.Error("Error creating request", err)
+			l.Error("Error creating request", "error", err)
 			http.Error(w, "Error creating request", http.StatusInternalServerError)
 			return
 		}
 		req.Header.Set("Content-Type", "application/json")
 
-		RequestBackend(
+		err = RequestBackend(
 			req,
 			func(line []byte) bool {
 				_, err := w.Write(line)
 				if err != nil {
-					l.Info("Error writing line", err)
+					l.Info("Error writing line", "error", err)
 					return false
 				}
 				flusher.Flush()
@@ -71,8 +163,8 @@ func NewDefaultHandler(
 		)
 
 		if err != nil {
-			l.Info("Error handeling request", err)
-			http.Error(w, "Error handeling request", http.StatusInternalServerError)
+			l.Info("Error handeling request", "error", err)
+			WriteBackendError(w, err)
 			return
 		}
 		l.Info("Finished Response")
@@ -0,0 +1,877 @@
+package jinja
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var globals = map[string]function{
+	"raise_exception": func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+		msg := "raise_exception called"
+		if len(args) > 0 {
+			msg = toString(args[0])
+		}
+		return nil, &Exception{Message: msg}
+	},
+	"namespace": func(args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+		ns := make(map[string]interface{})
+		for _, arg := range args {
+			if m, ok := arg.(map[string]interface{}); ok {
+				for k, v := range m {
+					ns[k] = v
+				}
+			}
+		}
+		for k, v := range kwargs {
+			ns[k] = v
+		}
+		return ns, nil
+	},
+	"dict": func(_ []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+		d := make(map[string]interface{}, len(kwargs))
+		for k, v := range kwargs {
+			d[k] = v
+		}
+		return d, nil
+	},
+	"range": func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+		bounds := make([]int, len(args))
+		for i, arg := range args {
+			n, ok := arg.(int)
+			if !ok {
+				return nil, errors.New("range arguments must be integers")
+			}
+			bounds[i] = n
+		}
+		start, stop, step := 0, 0, 1
+		switch len(bounds) {
+		case 1:
+			stop = bounds[0]
+		case 2:
+			start, stop = bounds[0], bounds[1]
+		case 3:
+			start, stop, step = bounds[0], bounds[1], bounds[2]
+		default:
+			return nil, errors.New("range expects 1 to 3 arguments")
+		}
+		if step == 0 {
+			return nil, errors.New("range step must not be zero")
+		}
+		items := []interface{}{}
+		for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+			items = append(items, i)
+		}
+		return items, nil
+	},
+	"strftime_now": func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("strftime_now expects a format")
+		}
+		return strftime(time.Now(), toString(args[0])), nil
+	},
+}
+
+// strftime formats t like Python's strftime for the common directives.
+func strftime(t time.Time, format string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			b.WriteString(strconv.Itoa(t.Year()))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'e':
+			b.WriteString(t.Format("_2"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'b', 'h':
+			b.WriteString(t.Format("Jan"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'I':
+			b.WriteString(t.Format("03"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'j':
+			b.WriteString(fmt.Sprintf("%03d", t.YearDay()))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
+
+type filter func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error)
+
+// arg returns the argument at position i or named name, def if there is
+// none.
+func arg(args []interface{}, kwargs map[string]interface{}, i int, name string, def interface{}) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	if v, ok := kwargs[name]; ok {
+		return v
+	}
+	return def
+}
+
+func stringFilter(f func(string) string) filter {
+	return func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+		return f(toString(v)), nil
+	}
+}
+
+var filters map[string]filter
+
+func init() {
+	filters = map[string]filter{
+		"trim": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			if chars := arg(args, kwargs, 0, "chars", nil); chars != nil {
+				return strings.Trim(toString(v), toString(chars)), nil
+			}
+			return strings.TrimSpace(toString(v)), nil
+		},
+		"length": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			return length(v)
+		},
+		"tojson": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			indent, _ := arg(args, kwargs, 0, "indent", nil).(int)
+			return toJSON(v, indent)
+		},
+		"string":     stringFilter(func(s string) string { return s }),
+		"upper":      stringFilter(strings.ToUpper),
+		"lower":      stringFilter(strings.ToLower),
+		"capitalize": stringFilter(capitalize),
+		"title":      stringFilter(title),
+		"safe":       stringFilter(func(s string) string { return s }),
+		"escape":     stringFilter(html.EscapeString),
+		"default": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			_, isUndefined := v.(undefinedValue)
+			boolean := truthy(arg(args, kwargs, 1, "boolean", false))
+			if isUndefined || (boolean && !truthy(v)) {
+				return arg(args, kwargs, 0, "default_value", ""), nil
+			}
+			return v, nil
+		},
+		"first": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			items, err := iterate(v)
+			if err != nil || len(items) == 0 {
+				return undefined, err
+			}
+			return items[0], nil
+		},
+		"last": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			items, err := iterate(v)
+			if err != nil || len(items) == 0 {
+				return undefined, err
+			}
+			return items[len(items)-1], nil
+		},
+		"join": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			attribute := arg(args, kwargs, 1, "attribute", nil)
+			parts := make([]string, len(items))
+			for i, item := range items {
+				if attribute != nil {
+					item = getAttr(item, toString(attribute))
+				}
+				parts[i] = toString(item)
+			}
+			return strings.Join(parts, toString(arg(args, kwargs, 0, "d", ""))), nil
+		},
+		"items": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				if _, isUndefined := v.(undefinedValue); isUndefined {
+					return []interface{}{}, nil
+				}
+				return nil, fmt.Errorf("items expects a mapping, got %s", repr(v))
+			}
+			return mappingItems(m), nil
+		},
+		"dictsort": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("dictsort expects a mapping, got %s", repr(v))
+			}
+			return mappingItems(m), nil
+		},
+		"list": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			items, err := iterate(v)
+			if items == nil {
+				items = []interface{}{}
+			}
+			return items, err
+		},
+		"int": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			def := arg(args, kwargs, 0, "default", 0)
+			if s, ok := v.(string); ok {
+				if i, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+					return i, nil
+				}
+				if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+					return int(f), nil
+				}
+				return def, nil
+			}
+			if f, ok := toFloat(v); ok {
+				return int(f), nil
+			}
+			return def, nil
+		},
+		"float": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+					return f, nil
+				}
+			} else if f, ok := toFloat(v); ok {
+				return f, nil
+			}
+			return arg(args, kwargs, 0, "default", 0.0), nil
+		},
+		"abs": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			switch n := v.(type) {
+			case int:
+				if n < 0 {
+					return -n, nil
+				}
+				return n, nil
+			case float64:
+				return math.Abs(n), nil
+			}
+			return nil, fmt.Errorf("abs expects a number, got %s", repr(v))
+		},
+		"round": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			f, ok := toFloat(v)
+			if !ok {
+				return nil, fmt.Errorf("round expects a number, got %s", repr(v))
+			}
+			precision, _ := arg(args, kwargs, 0, "precision", 0).(int)
+			scale := math.Pow(10, float64(precision))
+			switch toString(arg(args, kwargs, 1, "method", "common")) {
+			case "ceil":
+				return math.Ceil(f*scale) / scale, nil
+			case "floor":
+				return math.Floor(f*scale) / scale, nil
+			}
+			return math.Round(f*scale) / scale, nil
+		},
+		"replace": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			count, ok := arg(args, kwargs, 2, "count", -1).(int)
+			if !ok {
+				count = -1
+			}
+			return strings.Replace(toString(v),
+				toString(arg(args, kwargs, 0, "old", "")),
+				toString(arg(args, kwargs, 1, "new", "")), count), nil
+		},
+		"reverse": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				runes := []rune(s)
+				for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+					runes[i], runes[j] = runes[j], runes[i]
+				}
+				return string(runes), nil
+			}
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			reversed := make([]interface{}, len(items))
+			for i, item := range items {
+				reversed[len(items)-1-i] = item
+			}
+			return reversed, nil
+		},
+		"sort": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			sorted := append([]interface{}{}, items...)
+			reverse := truthy(arg(args, kwargs, 0, "reverse", false))
+			attribute := arg(args, kwargs, 2, "attribute", nil)
+			key := func(item interface{}) interface{} {
+				if attribute != nil {
+					return getAttr(item, toString(attribute))
+				}
+				return item
+			}
+			var sortErr error
+			sort.SliceStable(sorted, func(i, j int) bool {
+				c, err := compare(key(sorted[i]), key(sorted[j]))
+				if err != nil {
+					sortErr = err
+				}
+				if reverse {
+					return c > 0
+				}
+				return c < 0
+			})
+			return sorted, sortErr
+		},
+		"unique": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			unique := []interface{}{}
+			for _, item := range items {
+				if in, _ := contains(unique, item); !in {
+					unique = append(unique, item)
+				}
+			}
+			return unique, nil
+		},
+		"map": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			mapped := make([]interface{}, len(items))
+			if attribute, ok := kwargs["attribute"]; ok {
+				def, hasDefault := kwargs["default"]
+				for i, item := range items {
+					mapped[i] = getAttr(item, toString(attribute))
+					if _, isUndefined := mapped[i].(undefinedValue); isUndefined && hasDefault {
+						mapped[i] = def
+					}
+				}
+				return mapped, nil
+			}
+			if len(args) == 0 {
+				return nil, errors.New("map expects a filter or attribute")
+			}
+			f, ok := filters[toString(args[0])]
+			if !ok {
+				return nil, fmt.Errorf("unknown filter %s", toString(args[0]))
+			}
+			for i, item := range items {
+				if mapped[i], err = f(item, args[1:], nil); err != nil {
+					return nil, err
+				}
+			}
+			return mapped, nil
+		},
+		"select":     selectFilter(false, false),
+		"reject":     selectFilter(true, false),
+		"selectattr": selectFilter(false, true),
+		"rejectattr": selectFilter(true, true),
+		"indent": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			prefix := strings.Repeat(" ", 4)
+			switch width := arg(args, kwargs, 0, "width", 4).(type) {
+			case int:
+				prefix = strings.Repeat(" ", width)
+			case string:
+				prefix = width
+			}
+			first := truthy(arg(args, kwargs, 1, "first", false))
+			blank := truthy(arg(args, kwargs, 2, "blank", false))
+			lines := strings.Split(toString(v), "\n")
+			for i, line := range lines {
+				if (i > 0 || first) && (blank || strings.TrimSpace(line) != "") {
+					lines[i] = prefix + line
+				}
+			}
+			return strings.Join(lines, "\n"), nil
+		},
+		"sum": func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			attribute := arg(args, kwargs, 0, "attribute", nil)
+			var total interface{} = arg(args, kwargs, 1, "start", 0)
+			for _, item := range items {
+				if attribute != nil {
+					item = getAttr(item, toString(attribute))
+				}
+				if total, err = arithmetic("+", total, item); err != nil {
+					return nil, err
+				}
+			}
+			return total, nil
+		},
+		"min": extremeFilter(-1),
+		"max": extremeFilter(1),
+	}
+	filters["count"] = filters["length"]
+	filters["d"] = filters["default"]
+	filters["e"] = filters["escape"]
+}
+
+// selectFilter returns the select, reject, selectattr and rejectattr filters.
+func selectFilter(reject, byAttribute bool) filter {
+	return func(v interface{}, args []interface{}, _ map[string]interface{}) (interface{}, error) {
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		var attribute string
+		if byAttribute {
+			if len(args) == 0 {
+				return nil, errors.New("missing attribute")
+			}
+			attribute, args = toString(args[0]), args[1:]
+		}
+		test := func(v interface{}, _ []interface{}) (bool, error) { return truthy(v), nil }
+		if len(args) > 0 {
+			var ok bool
+			if test, ok = tests[toString(args[0])]; !ok {
+				return nil, fmt.Errorf("unknown test %s", toString(args[0]))
+			}
+			args = args[1:]
+		}
+		selected := []interface{}{}
+		for _, item := range items {
+			value := item
+			if byAttribute {
+				value = getAttr(item, attribute)
+			}
+			ok, err := test(value, args)
+			if err != nil {
+				return nil, err
+			}
+			if ok != reject {
+				selected = append(selected, item)
+			}
+		}
+		return selected, nil
+	}
+}
+
+func extremeFilter(sign int) filter {
+	return func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+		items, err := iterate(v)
+		if err != nil || len(items) == 0 {
+			return undefined, err
+		}
+		result := items[0]
+		for _, item := range items[1:] {
+			c, err := compare(item, result)
+			if err != nil {
+				return nil, err
+			}
+			if c*sign > 0 {
+				result = item
+			}
+		}
+		return result, nil
+	}
+}
+
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + strings.ToLower(s[size:])
+}
+
+func title(s string) string {
+	b := strings.Builder{}
+	start := true
+	for _, r := range s {
+		if start {
+			b.WriteRune(unicode.ToUpper(r))
+		} else {
+			b.WriteRune(unicode.ToLower(r))
+		}
+		start = !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+	return b.String()
+}
+
+func mappingItems(m map[string]interface{}) []interface{} {
+	items := make([]interface{}, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		items = append(items, []interface{}{k, m[k]})
+	}
+	return items
+}
+
+type test func(v interface{}, args []interface{}) (bool, error)
+
+func typeTest(check func(v interface{}) bool) test {
+	return func(v interface{}, _ []interface{}) (bool, error) {
+		return check(v), nil
+	}
+}
+
+func compareTest(check func(c int) bool) test {
+	return func(v interface{}, args []interface{}) (bool, error) {
+		if len(args) != 1 {
+			return false, errors.New("comparison test expects one argument")
+		}
+		c, err := compare(v, args[0])
+		return check(c), err
+	}
+}
+
+var tests map[string]test
+
+func init() {
+	tests = map[string]test{
+		"defined": typeTest(func(v interface{}) bool {
+			_, isUndefined := v.(undefinedValue)
+			return !isUndefined
+		}),
+		"undefined": typeTest(func(v interface{}) bool {
+			_, isUndefined := v.(undefinedValue)
+			return isUndefined
+		}),
+		"none":    typeTest(func(v interface{}) bool { return v == nil }),
+		"boolean": typeTest(func(v interface{}) bool { _, ok := v.(bool); return ok }),
+		"true":    typeTest(func(v interface{}) bool { b, ok := v.(bool); return ok && b }),
+		"false":   typeTest(func(v interface{}) bool { b, ok := v.(bool); return ok && !b }),
+		"integer": typeTest(func(v interface{}) bool { _, ok := v.(int); return ok }),
+		"float":   typeTest(func(v interface{}) bool { _, ok := v.(float64); return ok }),
+		"number": typeTest(func(v interface{}) bool {
+			switch v.(type) {
+			case int, float64:
+				return true
+			}
+			return false
+		}),
+		"string":  typeTest(func(v interface{}) bool { _, ok := v.(string); return ok }),
+		"mapping": typeTest(func(v interface{}) bool { _, ok := v.(map[string]interface{}); return ok }),
+		"sequence": typeTest(func(v interface{}) bool {
+			switch v.(type) {
+			case string, []interface{}, map[string]interface{}:
+				return true
+			}
+			return false
+		}),
+		"iterable": typeTest(func(v interface{}) bool {
+			switch v.(type) {
+			case string, []interface{}, map[string]interface{}:
+				return true
+			}
+			return false
+		}),
+		"callable": typeTest(func(v interface{}) bool { _, ok := v.(function); return ok }),
+		"lower":    typeTest(func(v interface{}) bool { s, ok := v.(string); return ok && s == strings.ToLower(s) }),
+		"upper":    typeTest(func(v interface{}) bool { s, ok := v.(string); return ok && s == strings.ToUpper(s) }),
+		"odd":      typeTest(func(v interface{}) bool { i, ok := v.(int); return ok && i%2 != 0 }),
+		"even":     typeTest(func(v interface{}) bool { i, ok := v.(int); return ok && i%2 == 0 }),
+		"divisibleby": func(v interface{}, args []interface{}) (bool, error) {
+			i, ok := v.(int)
+			n, nok := arg(args, nil, 0, "", nil).(int)
+			if !ok || !nok || n == 0 {
+				return false, errors.New("divisibleby expects integers")
+			}
+			return i%n == 0, nil
+		},
+		"eq": func(v interface{}, args []interface{}) (bool, error) {
+			return len(args) == 1 && equal(v, args[0]), nil
+		},
+		"ne": func(v interface{}, args []interface{}) (bool, error) {
+			return len(args) == 1 && !equal(v, args[0]), nil
+		},
+		"sameas": func(v interface{}, args []interface{}) (bool, error) {
+			if len(args) != 1 {
+				return false, nil
+			}
+			switch v.(type) {
+			case nil, bool:
+				return v == args[0], nil
+			}
+			return equal(v, args[0]), nil
+		},
+		"in": func(v interface{}, args []interface{}) (bool, error) {
+			if len(args) != 1 {
+				return false, errors.New("in expects one argument")
+			}
+			return contains(args[0], v)
+		},
+		"lt": compareTest(func(c int) bool { return c < 0 }),
+		"le": compareTest(func(c int) bool { return c <= 0 }),
+		"gt": compareTest(func(c int) bool { return c > 0 }),
+		"ge": compareTest(func(c int) bool { return c >= 0 }),
+	}
+	for alias, name := range map[string]string{
+		"equalto": "eq", "==": "eq", "!=": "ne", "<": "lt", "<=": "le",
+		">": "gt", ">=": "ge", "greaterthan": "gt", "lessthan": "lt",
+	} {
+		tests[alias] = tests[name]
+	}
+}
+
+// mappingMethod returns the dict method name bound to m, nil if there is
+// none.
+func mappingMethod(m map[string]interface{}, name string) function {
+	switch name {
+	case "items":
+		return function(func([]interface{}, map[string]interface{}) (interface{}, error) {
+			return mappingItems(m), nil
+		})
+	case "keys":
+		return function(func([]interface{}, map[string]interface{}) (interface{}, error) {
+			return iterate(m)
+		})
+	case "values":
+		return function(func([]interface{}, map[string]interface{}) (interface{}, error) {
+			values := []interface{}{}
+			for _, k := range sortedKeys(m) {
+				values = append(values, m[k])
+			}
+			return values, nil
+		})
+	case "get":
+		return function(func(args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			if len(args) == 0 {
+				return nil, errors.New("get expects a key")
+			}
+			if v, ok := m[toString(args[0])]; ok {
+				return v, nil
+			}
+			return arg(args, kwargs, 1, "default", nil), nil
+		})
+	}
+	return nil
+}
+
+// stringMethod returns the str method name bound to s, nil if there is none.
+func stringMethod(s string, name string) function {
+	chars := func(args []interface{}) (string, bool) {
+		if len(args) == 0 || args[0] == nil {
+			return "", false
+		}
+		return toString(args[0]), true
+	}
+	affix := func(args []interface{}, has func(string, string) bool) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s expects an argument", name)
+		}
+		if options, ok := args[0].([]interface{}); ok {
+			for _, option := range options {
+				if has(s, toString(option)) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return has(s, toString(args[0])), nil
+	}
+	switch name {
+	case "strip", "lstrip", "rstrip":
+		return function(func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+			cutset, ok := chars(args)
+			if !ok {
+				cutset = " \t\n\r\v\f"
+			}
+			switch name {
+			case "lstrip":
+				return strings.TrimLeft(s, cutset), nil
+			case "rstrip":
+				return strings.TrimRight(s, cutset), nil
+			}
+			return strings.Trim(s, cutset), nil
+		})
+	case "upper", "lower", "title", "capitalize":
+		return function(func([]interface{}, map[string]interface{}) (interface{}, error) {
+			return filters[name](s, nil, nil)
+		})
+	case "startswith":
+		return function(func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+			return affix(args, strings.HasPrefix)
+		})
+	case "endswith":
+		return function(func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+			return affix(args, strings.HasSuffix)
+		})
+	case "split":
+		return function(func(args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			maxsplit, _ := arg(args, kwargs, 1, "maxsplit", -1).(int)
+			var parts []string
+			if sep, ok := chars(args); ok {
+				n := -1
+				if maxsplit >= 0 {
+					n = maxsplit + 1
+				}
+				parts = strings.SplitN(s, sep, n)
+			} else {
+				parts = strings.Fields(s)
+			}
+			items := make([]interface{}, len(parts))
+			for i, part := range parts {
+				items[i] = part
+			}
+			return items, nil
+		})
+	case "replace":
+		return function(func(args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+			return filters["replace"](s, args, kwargs)
+		})
+	case "find":
+		return function(func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+			sub, _ := chars(args)
+			i := strings.Index(s, sub)
+			if i < 0 {
+				return -1, nil
+			}
+			return utf8.RuneCountInString(s[:i]), nil
+		})
+	case "count":
+		return function(func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+			sub, _ := chars(args)
+			return strings.Count(s, sub), nil
+		})
+	case "join":
+		return function(func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+			if len(args) == 0 {
+				return nil, errors.New("join expects an iterable")
+			}
+			return filters["join"](args[0], []interface{}{s}, nil)
+		})
+	case "splitlines":
+		return function(func([]interface{}, map[string]interface{}) (interface{}, error) {
+			items := []interface{}{}
+			for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+				items = append(items, strings.TrimSuffix(line, "\r"))
+			}
+			return items, nil
+		})
+	}
+	return nil
+}
+
+// toJSON encodes v like Python's json.dumps with ensure_ascii disabled.
+func toJSON(v interface{}, indent int) (string, error) {
+	b := strings.Builder{}
+	if err := writeJSON(&b, v, indent, 0); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func writeJSON(b *strings.Builder, v interface{}, indent, depth int) error {
+	newline := func(depth int) {
+		if indent > 0 {
+			b.WriteString("\n" + strings.Repeat(" ", indent*depth))
+		}
+	}
+	separator := ", "
+	if indent > 0 {
+		separator = ","
+	}
+	switch v := v.(type) {
+	case nil, undefinedValue:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case int:
+		b.WriteString(strconv.Itoa(v))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return fmt.Errorf("cannot encode %v as JSON", v)
+		}
+		b.WriteString(formatFloat(v))
+	case string:
+		b.WriteString(quoteJSON(v))
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return nil
+		}
+		b.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(separator)
+			}
+			newline(depth + 1)
+			if err := writeJSON(b, item, indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		b.WriteString("]")
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString("{}")
+			return nil
+		}
+		b.WriteString("{")
+		for i, k := range sortedKeys(v) {
+			if i > 0 {
+				b.WriteString(separator)
+			}
+			newline(depth + 1)
+			b.WriteString(quoteJSON(k) + ": ")
+			if err := writeJSON(b, v[k], indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		b.WriteString("}")
+	default:
+		return fmt.Errorf("cannot encode %s as JSON", repr(v))
+	}
+	return nil
+}
+
+func quoteJSON(s string) string {
+	b := strings.Builder{}
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,894 @@
+package jinja
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// undefinedValue is the value of missing variables, attributes and items.
+type undefinedValue struct{}
+
+var undefined = undefinedValue{}
+
+// function is a callable template value.
+type function func(args []interface{}, kwargs map[string]interface{}) (interface{}, error)
+
+var (
+	errBreak    = errors.New("break")
+	errContinue = errors.New("continue")
+)
+
+type scope struct {
+	vars   map[string]interface{}
+	parent *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{vars: make(map[string]interface{}), parent: parent}
+}
+
+func (s *scope) lookup(name string) interface{} {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v
+		}
+	}
+	return undefined
+}
+
+// maxMacroDepth limits nested macro calls, so recursive macros fail instead
+// of overflowing the stack.
+const maxMacroDepth = 100
+
+type renderer struct {
+	out *strings.Builder
+	// depth counts the macro calls in progress, shared by the renderers of a
+	// template's execution.
+	depth *int
+}
+
+func (r *renderer) render(nodes []node, s *scope) error {
+	for _, n := range nodes {
+		if err := r.renderNode(n, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *renderer) renderNode(n node, s *scope) error {
+	switch n := n.(type) {
+	case textNode:
+		r.out.WriteString(string(n))
+	case outputNode:
+		v, err := r.eval(n.e, s)
+		if err != nil {
+			return err
+		}
+		r.out.WriteString(toString(v))
+	case ifNode:
+		for i, cond := range n.conds {
+			v, err := r.eval(cond, s)
+			if err != nil {
+				return err
+			}
+			if truthy(v) {
+				return r.render(n.bodies[i], s)
+			}
+		}
+		return r.render(n.els, s)
+	case forNode:
+		return r.renderFor(n, s)
+	case setNode:
+		var v interface{}
+		if n.value != nil {
+			var err error
+			if v, err = r.eval(n.value, s); err != nil {
+				return err
+			}
+		} else {
+			out := strings.Builder{}
+			if err := (&renderer{out: &out, depth: r.depth}).render(n.body, s); err != nil {
+				return err
+			}
+			v = out.String()
+		}
+		if n.attr == "" {
+			s.vars[n.name] = v
+			return nil
+		}
+		ns, ok := s.lookup(n.name).(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("cannot set attribute %s of %s", n.attr, n.name)
+		}
+		ns[n.attr] = v
+	case macroNode:
+		s.vars[n.name] = r.macro(n, s)
+	case breakNode:
+		return errBreak
+	case continueNode:
+		return errContinue
+	}
+	return nil
+}
+
+func (r *renderer) renderFor(n forNode, s *scope) error {
+	iter, err := r.eval(n.iter, s)
+	if err != nil {
+		return err
+	}
+	items, err := iterate(iter)
+	if err != nil {
+		return err
+	}
+	bind := func(scope *scope, item interface{}) error {
+		if len(n.targets) == 1 {
+			scope.vars[n.targets[0]] = item
+			return nil
+		}
+		values, ok := item.([]interface{})
+		if !ok || len(values) != len(n.targets) {
+			return fmt.Errorf("cannot unpack %s into %d values", toString(item), len(n.targets))
+		}
+		for i, target := range n.targets {
+			scope.vars[target] = values[i]
+		}
+		return nil
+	}
+	if n.filter != nil {
+		var filtered []interface{}
+		for _, item := range items {
+			scope := newScope(s)
+			if err := bind(scope, item); err != nil {
+				return err
+			}
+			keep, err := r.eval(n.filter, scope)
+			if err != nil {
+				return err
+			}
+			if truthy(keep) {
+				filtered = append(filtered, item)
+			}
+		}
+		items = filtered
+	}
+	if len(items) == 0 {
+		return r.render(n.els, s)
+	}
+	for i, item := range items {
+		scope := newScope(s)
+		if err := bind(scope, item); err != nil {
+			return err
+		}
+		loop := map[string]interface{}{
+			"index":     i + 1,
+			"index0":    i,
+			"revindex":  len(items) - i,
+			"revindex0": len(items) - i - 1,
+			"first":     i == 0,
+			"last":      i == len(items)-1,
+			"length":    len(items),
+			"depth":     1,
+			"depth0":    0,
+			"previtem":  undefined,
+			"nextitem":  undefined,
+			"cycle": function(func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+				if len(args) == 0 {
+					return nil, errors.New("cycle needs at least one value")
+				}
+				return args[i%len(args)], nil
+			}),
+		}
+		if i > 0 {
+			loop["previtem"] = items[i-1]
+		}
+		if i < len(items)-1 {
+			loop["nextitem"] = items[i+1]
+		}
+		scope.vars["loop"] = loop
+		err := r.render(n.body, scope)
+		if errors.Is(err, errBreak) {
+			break
+		}
+		if err != nil && !errors.Is(err, errContinue) {
+			return err
+		}
+	}
+	return nil
+}
+
+// macro returns the function calling macro n defined in s.
+func (r *renderer) macro(n macroNode, s *scope) function {
+	return func(args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+		if *r.depth >= maxMacroDepth {
+			return nil, fmt.Errorf("macro %s: maximum recursion depth of %d exceeded", n.name, maxMacroDepth)
+		}
+		*r.depth++
+		defer func() { *r.depth-- }()
+		scope := newScope(s)
+		for i, param := range n.params {
+			switch v, ok := kwargs[param]; {
+			case i < len(args):
+				scope.vars[param] = args[i]
+			case ok:
+				scope.vars[param] = v
+			case n.defaults[i] != nil:
+				def, err := r.eval(n.defaults[i], scope)
+				if err != nil {
+					return nil, err
+				}
+				scope.vars[param] = def
+			default:
+				scope.vars[param] = undefined
+			}
+		}
+		out := strings.Builder{}
+		if err := (&renderer{out: &out, depth: r.depth}).render(n.body, scope); err != nil {
+			return nil, err
+		}
+		return out.String(), nil
+	}
+}
+
+func (r *renderer) eval(e expr, s *scope) (interface{}, error) {
+	switch e := e.(type) {
+	case literal:
+		return e.v, nil
+	case nameExpr:
+		return s.lookup(e.name), nil
+	case listExpr:
+		items := make([]interface{}, len(e.items))
+		for i, item := range e.items {
+			v, err := r.eval(item, s)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = v
+		}
+		return items, nil
+	case dictExpr:
+		d := make(map[string]interface{}, len(e.keys))
+		for i := range e.keys {
+			k, err := r.eval(e.keys[i], s)
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.eval(e.values[i], s)
+			if err != nil {
+				return nil, err
+			}
+			d[toString(k)] = v
+		}
+		return d, nil
+	case attrExpr:
+		obj, err := r.eval(e.obj, s)
+		if err != nil {
+			return nil, err
+		}
+		return getAttr(obj, e.name), nil
+	case indexExpr:
+		obj, err := r.eval(e.obj, s)
+		if err != nil {
+			return nil, err
+		}
+		index, err := r.eval(e.index, s)
+		if err != nil {
+			return nil, err
+		}
+		return getItem(obj, index), nil
+	case sliceExpr:
+		return r.evalSlice(e, s)
+	case callExpr:
+		fn, err := r.eval(e.fn, s)
+		if err != nil {
+			return nil, err
+		}
+		args, kwargs, err := r.evalArgs(e.args, e.kwargs, s)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := fn.(function)
+		if !ok {
+			return nil, fmt.Errorf("%s is not callable", describe(e.fn))
+		}
+		return f(args, kwargs)
+	case filterExpr:
+		v, err := r.eval(e.e, s)
+		if err != nil {
+			return nil, err
+		}
+		args, kwargs, err := r.evalArgs(e.args, e.kwargs, s)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := filters[e.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %s", e.name)
+		}
+		return f(v, args, kwargs)
+	case testExpr:
+		v, err := r.eval(e.e, s)
+		if err != nil {
+			return nil, err
+		}
+		args, _, err := r.evalArgs(e.args, nil, s)
+		if err != nil {
+			return nil, err
+		}
+		t, ok := tests[e.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown test %s", e.name)
+		}
+		result, err := t(v, args)
+		return result != e.negate, err
+	case unaryExpr:
+		v, err := r.eval(e.e, s)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "not" {
+			return !truthy(v), nil
+		}
+		return arithmetic("-", 0, v)
+	case binaryExpr:
+		l, err := r.eval(e.l, s)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "and":
+			if !truthy(l) {
+				return l, nil
+			}
+			return r.eval(e.r, s)
+		case "or":
+			if truthy(l) {
+				return l, nil
+			}
+			return r.eval(e.r, s)
+		}
+		rv, err := r.eval(e.r, s)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := l.(undefinedValue); ok && e.op != "==" && e.op != "!=" && e.op != "~" {
+			return nil, fmt.Errorf("%s is undefined", describe(e.l))
+		}
+		if _, ok := rv.(undefinedValue); ok && e.op != "==" && e.op != "!=" && e.op != "~" {
+			return nil, fmt.Errorf("%s is undefined", describe(e.r))
+		}
+		return binary(e.op, l, rv)
+	case condExpr:
+		cond, err := r.eval(e.cond, s)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return r.eval(e.then, s)
+		}
+		if e.els == nil {
+			return undefined, nil
+		}
+		return r.eval(e.els, s)
+	}
+	return nil, fmt.Errorf("unknown expression %T", e)
+}
+
+func (r *renderer) evalArgs(
+	args []expr, kwargs []kwarg, s *scope,
+) ([]interface{}, map[string]interface{}, error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		v, err := r.eval(arg, s)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i] = v
+	}
+	named := make(map[string]interface{}, len(kwargs))
+	for _, kw := range kwargs {
+		v, err := r.eval(kw.e, s)
+		if err != nil {
+			return nil, nil, err
+		}
+		named[kw.name] = v
+	}
+	return values, named, nil
+}
+
+func (r *renderer) evalSlice(e sliceExpr, s *scope) (interface{}, error) {
+	obj, err := r.eval(e.obj, s)
+	if err != nil {
+		return nil, err
+	}
+	var bounds [3]*int
+	for i, part := range []expr{e.start, e.stop, e.step} {
+		if part == nil {
+			continue
+		}
+		v, err := r.eval(part, s)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		n, ok := v.(int)
+		if !ok {
+			return nil, fmt.Errorf("slice indices must be integers")
+		}
+		bounds[i] = &n
+	}
+	switch obj := obj.(type) {
+	case []interface{}:
+		var items []interface{}
+		for _, i := range sliceIndices(len(obj), bounds) {
+			items = append(items, obj[i])
+		}
+		if items == nil {
+			items = []interface{}{}
+		}
+		return items, nil
+	case string:
+		runes := []rune(obj)
+		b := strings.Builder{}
+		for _, i := range sliceIndices(len(runes), bounds) {
+			b.WriteRune(runes[i])
+		}
+		return b.String(), nil
+	}
+	return nil, fmt.Errorf("%s cannot be sliced", describe(e.obj))
+}
+
+// sliceIndices returns the indices selected by slicing a sequence of length
+// n with Python semantics.
+func sliceIndices(n int, bounds [3]*int) []int {
+	step := 1
+	if bounds[2] != nil {
+		step = *bounds[2]
+	}
+	if step == 0 {
+		return nil
+	}
+	clamp := func(b *int, def int) int {
+		if b == nil {
+			return def
+		}
+		i := *b
+		if i < 0 {
+			i += n
+		}
+		if step > 0 {
+			return max(0, min(i, n))
+		}
+		return max(-1, min(i, n-1))
+	}
+	var indices []int
+	if step > 0 {
+		for i := clamp(bounds[0], 0); i < clamp(bounds[1], n); i += step {
+			indices = append(indices, i)
+		}
+	} else {
+		for i := clamp(bounds[0], n-1); i > clamp(bounds[1], -1); i += step {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// describe names the expression e in errors.
+func describe(e expr) string {
+	switch e := e.(type) {
+	case nameExpr:
+		return "'" + e.name + "'"
+	case attrExpr:
+		return describe(e.obj) + "." + e.name
+	}
+	return "value"
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil, undefinedValue:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+// toString converts v to a string like Python's str.
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case undefinedValue:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = repr(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case map[string]interface{}:
+		parts := make([]string, 0, len(v))
+		for _, k := range sortedKeys(v) {
+			parts = append(parts, repr(k)+": "+repr(v[k]))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return repr(v)
+}
+
+// repr converts v to a string like Python's repr.
+func repr(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case undefinedValue:
+		return ""
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return formatFloat(v)
+	case string:
+		quote := "'"
+		if strings.Contains(v, "'") && !strings.Contains(v, `"`) {
+			quote = `"`
+		}
+		r := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`, quote, `\`+quote)
+		return quote + r.Replace(v) + quote
+	case function:
+		return "<function>"
+	}
+	return toString(v)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if strings.ContainsAny(s, "e") {
+		return s
+	}
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// iterate returns the items of v: the elements of lists, the keys of
+// mappings and the characters of strings.
+func iterate(v interface{}) ([]interface{}, error) {
+	switch v := v.(type) {
+	case nil, undefinedValue:
+		return nil, nil
+	case []interface{}:
+		return v, nil
+	case map[string]interface{}:
+		keys := sortedKeys(v)
+		items := make([]interface{}, len(keys))
+		for i, k := range keys {
+			items[i] = k
+		}
+		return items, nil
+	case string:
+		var items []interface{}
+		for _, c := range v {
+			items = append(items, string(c))
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%s is not iterable", repr(v))
+}
+
+func length(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case undefinedValue:
+		return 0, nil
+	case string:
+		return utf8.RuneCountInString(v), nil
+	case []interface{}:
+		return len(v), nil
+	case map[string]interface{}:
+		return len(v), nil
+	}
+	return 0, fmt.Errorf("%s has no length", repr(v))
+}
+
+func getAttr(obj interface{}, name string) interface{} {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		if method := mappingMethod(o, name); method != nil {
+			return method
+		}
+		if v, ok := o[name]; ok {
+			return v
+		}
+	case string:
+		if method := stringMethod(o, name); method != nil {
+			return method
+		}
+	}
+	return undefined
+}
+
+func getItem(obj interface{}, index interface{}) interface{} {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		if v, ok := o[toString(index)]; ok {
+			return v
+		}
+		if name, ok := index.(string); ok {
+			return getAttr(obj, name)
+		}
+	case []interface{}:
+		if i, ok := index.(int); ok {
+			if i < 0 {
+				i += len(o)
+			}
+			if i >= 0 && i < len(o) {
+				return o[i]
+			}
+		}
+	case string:
+		if i, ok := index.(int); ok {
+			runes := []rune(o)
+			if i < 0 {
+				i += len(runes)
+			}
+			if i >= 0 && i < len(runes) {
+				return string(runes[i])
+			}
+		}
+	}
+	return undefined
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func equal(l, r interface{}) bool {
+	if lf, ok := toFloat(l); ok {
+		rf, ok := toFloat(r)
+		return ok && lf == rf
+	}
+	switch l := l.(type) {
+	case []interface{}:
+		r, ok := r.([]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if !equal(l[i], r[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		r, ok := r.(map[string]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for k, v := range l {
+			if rv, ok := r[k]; !ok || !equal(v, rv) {
+				return false
+			}
+		}
+		return true
+	case function:
+		return false
+	case nil, undefinedValue, string:
+		return l == r
+	}
+	return false
+}
+
+// compare returns -1, 0 or 1 if l is less than, equal to or greater than r.
+func compare(l, r interface{}) (int, error) {
+	if lf, ok := toFloat(l); ok {
+		if rf, ok := toFloat(r); ok {
+			switch {
+			case lf < rf:
+				return -1, nil
+			case lf > rf:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if ls, ok := l.(string); ok {
+		if rs, ok := r.(string); ok {
+			return strings.Compare(ls, rs), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s and %s", repr(l), repr(r))
+}
+
+func contains(container, item interface{}) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return false, fmt.Errorf("'in <string>' requires string as left operand")
+		}
+		return strings.Contains(c, s), nil
+	case []interface{}:
+		for _, v := range c {
+			if equal(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}:
+		s, ok := item.(string)
+		if !ok {
+			return false, nil
+		}
+		_, exists := c[s]
+		return exists, nil
+	case nil, undefinedValue:
+		return false, nil
+	}
+	return false, fmt.Errorf("%s is not a container", repr(container))
+}
+
+func binary(op string, l, r interface{}) (interface{}, error) {
+	switch op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "<", ">", "<=", ">=":
+		c, err := compare(l, r)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]bool{"<": c < 0, ">": c > 0, "<=": c <= 0, ">=": c >= 0}[op], nil
+	case "in":
+		return contains(r, l)
+	case "not in":
+		in, err := contains(r, l)
+		return !in, err
+	case "~":
+		return toString(l) + toString(r), nil
+	}
+	return arithmetic(op, l, r)
+}
+
+func arithmetic(op string, l, r interface{}) (interface{}, error) {
+	switch op {
+	case "+":
+		switch lv := l.(type) {
+		case string:
+			if rv, ok := r.(string); ok {
+				return lv + rv, nil
+			}
+		case []interface{}:
+			if rv, ok := r.([]interface{}); ok {
+				return append(append([]interface{}{}, lv...), rv...), nil
+			}
+		}
+	case "*":
+		if n, ok := r.(int); ok {
+			switch lv := l.(type) {
+			case string:
+				return strings.Repeat(lv, max(n, 0)), nil
+			case []interface{}:
+				var items []interface{}
+				for i := 0; i < n; i++ {
+					items = append(items, lv...)
+				}
+				return items, nil
+			}
+		}
+	}
+	li, lInt := l.(int)
+	ri, rInt := r.(int)
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if !lok || !rok {
+		return nil, fmt.Errorf("unsupported operand types for %s: %s and %s", op, repr(l), repr(r))
+	}
+	_, lBool := l.(bool)
+	_, rBool := r.(bool)
+	ints := (lInt || lBool) && (rInt || rBool)
+	if ints {
+		li, ri = int(lf), int(rf)
+	}
+	switch op {
+	case "+":
+		if ints {
+			return li + ri, nil
+		}
+		return lf + rf, nil
+	case "-":
+		if ints {
+			return li - ri, nil
+		}
+		return lf - rf, nil
+	case "*":
+		if ints {
+			return li * ri, nil
+		}
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return lf / rf, nil
+	case "//", "%":
+		if rf == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if ints {
+			q, m := li/ri, li%ri
+			if m != 0 && (m < 0) != (ri < 0) {
+				q--
+				m += ri
+			}
+			if op == "//" {
+				return q, nil
+			}
+			return m, nil
+		}
+		q := math.Floor(lf / rf)
+		if op == "//" {
+			return q, nil
+		}
+		return lf - q*rf, nil
+	case "**":
+		if ints && ri >= 0 {
+			return int(math.Pow(lf, rf)), nil
+		}
+		return math.Pow(lf, rf), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
@@ -0,0 +1,119 @@
+// Package jinja implements the subset of Jinja2 used by the chat templates
+// models ship in GGUF metadata and tokenizer_config.json, so prompts can be
+// rendered with a model's official template instead of a hand-written port.
+//
+// Templates are rendered the way transformers renders chat templates: with
+// trim_blocks, lstrip_blocks and the loopcontrols extension, and the
+// raise_exception, strftime_now and namespace globals. Supported are
+// expressions, filters and tests common in chat templates, the if, for, set
+// and macro statements, break and continue. Not supported are template
+// inheritance, includes, call blocks and autoescaping.
+//
+// Values are none (nil), bool, int, float64, string, lists ([]interface{})
+// and mappings (map[string]interface{}). Mappings are iterated, listed and
+// encoded in key order.
+package jinja
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Template is a parsed Jinja template, safe for concurrent use.
+type Template struct {
+	body []node
+}
+
+// Exception is returned by Execute when the template calls raise_exception,
+// e.g. for conversations the model does not support.
+type Exception struct {
+	Message string
+}
+
+func (e *Exception) Error() string {
+	return e.Message
+}
+
+// Parse parses the Jinja template src.
+func Parse(src string) (*Template, error) {
+	segs, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{segs: segs}
+	body, _, err := p.parseBody()
+	if err != nil {
+		return nil, err
+	}
+	return &Template{body: body}, nil
+}
+
+// Execute renders the template with vars to w. The values of vars are
+// converted to template values as if encoded as JSON.
+func (t *Template) Execute(w io.Writer, vars map[string]interface{}) error {
+	root := newScope(nil)
+	for name, fn := range globals {
+		root.vars[name] = fn
+	}
+	for name, v := range vars {
+		value, err := normalize(v)
+		if err != nil {
+			return fmt.Errorf("variable %s: %w", name, err)
+		}
+		root.vars[name] = value
+	}
+	out := strings.Builder{}
+	depth := 0
+	r := &renderer{out: &out, depth: &depth}
+	if err := r.render(t.body, root); err != nil {
+		if errors.Is(err, errBreak) || errors.Is(err, errContinue) {
+			return errors.New("break or continue outside of loop")
+		}
+		return err
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// normalize converts v to template values by encoding it as JSON.
+func normalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, bool, int, float64, string, function:
+		return v, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	var decoded interface{}
+	if err := dec.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return fromJSON(decoded), nil
+}
+
+// fromJSON converts the numbers of a decoded JSON value to int or float64.
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = fromJSON(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = fromJSON(v[k])
+		}
+	}
+	return v
+}
@@ -0,0 +1,193 @@
+package jinja
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func render(t *testing.T, src string, vars map[string]interface{}) string {
+	t.Helper()
+	tmpl, err := Parse(src)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", src, err)
+	}
+	out := strings.Builder{}
+	if err := tmpl.Execute(&out, vars); err != nil {
+		t.Fatalf("rendering %q: %v", src, err)
+	}
+	return out.String()
+}
+
+func conversation() []map[string]interface{} {
+	return []map[string]interface{}{
+		{"role": "system", "content": "You are helpful."},
+		{"role": "user", "content": "Hi"},
+		{"role": "assistant", "content": "Hello!"},
+		{"role": "user", "content": "Weather in Berlin?"},
+	}
+}
+
+func TestChatTemplates(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		template string
+		messages []map[string]interface{}
+		expected string
+	}{
+		{
+			name:     "zephyr",
+			template: "{% for message in messages %}\n{% if message['role'] == 'user' %}\n{{ '<|user|>\n' + message['content'] + eos_token }}\n{% elif message['role'] == 'system' %}\n{{ '<|system|>\n' + message['content'] + eos_token }}\n{% elif message['role'] == 'assistant' %}\n{{ '<|assistant|>\n'  + message['content'] + eos_token }}\n{% endif %}\n{% if loop.last and add_generation_prompt %}\n{{ '<|assistant|>' }}\n{% endif %}\n{% endfor %}",
+			messages: conversation(),
+			expected: "<|system|>\nYou are helpful.</s>\n<|user|>\nHi</s>\n<|assistant|>\nHello!</s>\n<|user|>\nWeather in Berlin?</s>\n<|assistant|>\n",
+		},
+		{
+			name:     "llama3",
+			template: "{% set loop_messages = messages %}{% for message in loop_messages %}{% set content = '<|start_header_id|>' + message['role'] + '<|end_header_id|>\n\n'+ message['content'] | trim + '<|eot_id|>' %}{% if loop.index0 == 0 %}{% set content = bos_token + content %}{% endif %}{{ content }}{% endfor %}{% if add_generation_prompt %}{{ '<|start_header_id|>assistant<|end_header_id|>\n\n' }}{% endif %}",
+			messages: conversation()[1:],
+			expected: "<s><|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\nHello!<|eot_id|><|start_header_id|>user<|end_header_id|>\n\nWeather in Berlin?<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n",
+		},
+		{
+			name:     "mistral",
+			template: "{{ bos_token }}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if message['role'] == 'user' %}{{ '[INST] ' + message['content'] + ' [/INST]' }}{% elif message['role'] == 'assistant' %}{{ message['content'] + eos_token}}{% else %}{{ raise_exception('Only user and assistant roles are supported!') }}{% endif %}{% endfor %}",
+			messages: conversation()[1:],
+			expected: "<s>[INST] Hi [/INST]Hello!</s>[INST] Weather in Berlin? [/INST]",
+		},
+		{
+			name: "qwen tools",
+			template: `{%- for message in messages %}
+    {%- if (message.role == "user") or (message.role == "system" and not loop.first) or (message.role == "assistant" and not message.tool_calls) %}
+        {{- '<|im_start|>' + message.role + '\n' + message.content + '<|im_end|>' + '\n' }}
+    {%- elif message.role == "assistant" %}
+        {{- '<|im_start|>' + message.role }}
+        {%- if message.content %}
+            {{- '\n' + message.content }}
+        {%- endif %}
+        {%- for tool_call in message.tool_calls %}
+            {%- if tool_call.function is defined %}
+                {%- set tool_call = tool_call.function %}
+            {%- endif %}
+            {{- '\n<tool_call>\n{"name": "' }}
+            {{- tool_call.name }}
+            {{- '", "arguments": ' }}
+            {{- tool_call.arguments | tojson }}
+            {{- '}\n</tool_call>' }}
+        {%- endfor %}
+        {{- '<|im_end|>\n' }}
+    {%- elif message.role == "tool" %}
+        {%- if (loop.index0 == 0) or (messages[loop.index0 - 1].role != "tool") %}
+            {{- '<|im_start|>user' }}
+        {%- endif %}
+        {{- '\n<tool_response>\n' }}
+        {{- message.content }}
+        {{- '\n</tool_response>' }}
+        {%- if loop.last or (messages[loop.index0 + 1].role != "tool") %}
+            {{- '<|im_end|>\n' }}
+        {%- endif %}
+    {%- endif %}
+{%- endfor %}
+{%- if add_generation_prompt %}
+    {{- '<|im_start|>assistant\n' }}
+{%- endif %}
+`,
+			messages: []map[string]interface{}{
+				{"role": "user", "content": "Weather in Berlin and Paris?"},
+				{"role": "assistant", "content": "", "tool_calls": []interface{}{
+					map[string]interface{}{"function": map[string]interface{}{
+						"name": "weather", "arguments": map[string]interface{}{"city": "Berlin"}}},
+					map[string]interface{}{"function": map[string]interface{}{
+						"name": "weather", "arguments": map[string]interface{}{"city": "Paris"}}},
+				}},
+				{"role": "tool", "content": "21"},
+				{"role": "tool", "content": "24"},
+			},
+			expected: "<|im_start|>user\nWeather in Berlin and Paris?<|im_end|>\n" +
+				"<|im_start|>assistant\n<tool_call>\n{\"name\": \"weather\", \"arguments\": {\"city\": \"Berlin\"}}\n</tool_call>" +
+				"\n<tool_call>\n{\"name\": \"weather\", \"arguments\": {\"city\": \"Paris\"}}\n</tool_call><|im_end|>\n" +
+				"<|im_start|>user\n<tool_response>\n21\n</tool_response>\n<tool_response>\n24\n</tool_response><|im_end|>\n" +
+				"<|im_start|>assistant\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := render(t, tc.template, map[string]interface{}{
+				"messages":              tc.messages,
+				"bos_token":             "<s>",
+				"eos_token":             "</s>",
+				"add_generation_prompt": true,
+			})
+			if got != tc.expected {
+				t.Errorf("expected\n%q\ngot\n%q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRaiseException(t *testing.T) {
+	tmpl, err := Parse(`{% if messages[0].role != 'user' %}{{ raise_exception('first message must be from the user') }}{% endif %}`)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	err = tmpl.Execute(&strings.Builder{}, map[string]interface{}{"messages": conversation()})
+	var exception *Exception
+	if !errors.As(err, &exception) || exception.Message != "first message must be from the user" {
+		t.Errorf("expected exception; got %v", err)
+	}
+}
+
+func TestMacroRecursion(t *testing.T) {
+	tmpl, err := Parse(`{% macro f(n) %}{{ f(n) }}{% endmacro %}{{ f(1) }}`)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	if err := tmpl.Execute(&strings.Builder{}, nil); err == nil {
+		t.Errorf("expected an error for unbounded recursion")
+	}
+
+	countdown := `{% macro f(n) %}{{ n }}{% if n > 0 %}{{ f(n - 1) }}{% endif %}{% endmacro %}{{ f(3) }}`
+	if got := render(t, countdown, nil); got != "3210" {
+		t.Errorf("expected 3210; got %q", got)
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	for _, tc := range []struct {
+		template string
+		expected string
+	}{
+		{`{{ 1 + 2 * 3 }} {{ 7 // 2 }} {{ -7 % 3 }} {{ 7 / 2 }}`, `7 3 2 3.5`},
+		{`{{ 'a' ~ 1 ~ none }} {{ [1, 'b', true] }} {{ {'k': none} }}`, `a1None [1, 'b', True] {'k': None}`},
+		{`{{ 'x' if false }}|{{ 'y' if false else 'z' }}`, `|z`},
+		{`{{ missing is defined }} {{ missing.attr is not defined }} {{ none is none }}`, `False True True`},
+		{`{{ '  hi  ' | trim | upper }} {{ [3, 1, 2] | sort | join(', ') }} {{ 'abc' | length }}`, `HI 1, 2, 3 3`},
+		{`{{ 'hello'[1:3] }} {{ [1, 2, 3][::-1] }} {{ [1, 2, 3][-1] }}`, `el [3, 2, 1] 3`},
+		{`{{ ' a b '.strip().split(' ') }} {{ 'abc'.startswith(('x', 'a')) }}`, `['a', 'b'] True`},
+		{`{{ {'b': [1, 2], 'a': 'ü'} | tojson }}`, `{"a": "ü", "b": [1, 2]}`},
+		{`{{ {'a': 1} | tojson(indent=2) }}`, "{\n  \"a\": 1\n}"},
+		{`{% set ns = namespace(found=false) %}{% for i in range(5) %}{% if i == 3 %}{% set ns.found = true %}{% break %}{% endif %}{{ i }}{% endfor %}{{ ns.found }}`, `012True`},
+		{`{% for k, v in {'b': 2, 'a': 1}.items() %}{{ k }}={{ v }}{{ ', ' if not loop.last }}{% endfor %}`, `a=1, b=2`},
+		{`{% for x in [1, 2, 3, 4] if x is even %}{{ x }}{% else %}none{% endfor %}`, `24`},
+		{`{% for x in [] %}{{ x }}{% else %}empty{% endfor %}`, `empty`},
+		{`{% macro greet(name, punct='!') %}Hi {{ name }}{{ punct }}{% endmacro %}{{ greet('Ada') }} {{ greet('Bob', punct='?') }}`, `Hi Ada! Hi Bob?`},
+		{`{% set block %}inner{% endset %}{{ block | upper }}`, `INNER`},
+		{`{{ [{'n': 1}, {'n': 2}] | map(attribute='n') | list }} {{ [{'t': 'a'}, {'t': 'b'}] | selectattr('t', 'equalto', 'b') | list | length }}`, `[1, 2] 1`},
+		{"  {%- if true %}\n  yes\n  {% endif %}\n", "  yes\n"},
+	} {
+		if got := render(t, tc.template, nil); got != tc.expected {
+			t.Errorf("rendering %s: expected %q; got %q", tc.template, tc.expected, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		`{% if true %}unclosed`,
+		`{{ 1 + }}`,
+		`{% for %}{% endfor %}`,
+		`{{ 'unterminated }}`,
+		`{% include 'other' %}`,
+	} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("expected error parsing %q", src)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package jinja
+
+import (
+	"fmt"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	segText segmentKind = iota
+	segOutput
+	segStatement
+)
+
+// segment is literal text, an {{ expression }} or a {% statement %} of a
+// template, after whitespace control.
+type segment struct {
+	kind segmentKind
+	text string
+	line int
+}
+
+type tag struct {
+	kind      byte // '{', '%' or '#'
+	content   string
+	trimLeft  bool
+	trimRight bool
+	noLstrip  bool
+	line      int
+}
+
+// lex splits src into segments. Like transformers renders chat templates,
+// trim_blocks and lstrip_blocks are enabled: the first newline after a block
+// tag is removed, as are spaces and tabs from the start of a line up to a
+// block tag.
+func lex(src string) ([]segment, error) {
+	var texts []string
+	var tags []tag
+	pos, line := 0, 1
+	for {
+		i := tagStart(src[pos:])
+		if i < 0 {
+			texts = append(texts, src[pos:])
+			break
+		}
+		texts = append(texts, src[pos:pos+i])
+		line += strings.Count(src[pos:pos+i], "\n")
+		start := pos + i
+		t := tag{kind: src[start+1], line: line}
+		inner := start + 2
+		if inner < len(src) && (src[inner] == '-' || src[inner] == '+') {
+			t.trimLeft = src[inner] == '-'
+			t.noLstrip = src[inner] == '+'
+			inner++
+		}
+		closing := map[byte]string{'{': "}}", '%': "%}", '#': "#}"}[t.kind]
+		end := tagEnd(src, inner, closing, t.kind != '#')
+		if end < 0 {
+			return nil, fmt.Errorf("line %d: unclosed tag", line)
+		}
+		content := src[inner:end]
+		if strings.HasSuffix(content, "-") {
+			t.trimRight = true
+			content = content[:len(content)-1]
+		} else if strings.HasSuffix(content, "+") && t.kind != '{' {
+			content = content[:len(content)-1]
+		}
+		t.content = strings.TrimSpace(content)
+		tags = append(tags, t)
+		line += strings.Count(src[start:end], "\n")
+		pos = end + 2
+	}
+
+	// whitespace before tags is decided on the source, before whitespace
+	// after tags is removed
+	for i, t := range tags {
+		if t.trimLeft {
+			texts[i] = strings.TrimRight(texts[i], " \t\r\n")
+		} else if t.kind != '{' && !t.noLstrip {
+			texts[i] = lstripBlock(texts[i], i == 0)
+		}
+	}
+	for i, t := range tags {
+		if t.trimRight {
+			texts[i+1] = strings.TrimLeft(texts[i+1], " \t\r\n")
+		} else if t.kind != '{' {
+			if strings.HasPrefix(texts[i+1], "\n") {
+				texts[i+1] = texts[i+1][1:]
+			} else if strings.HasPrefix(texts[i+1], "\r\n") {
+				texts[i+1] = texts[i+1][2:]
+			}
+		}
+	}
+
+	var segs []segment
+	textLine := 1
+	for i, text := range texts {
+		if text != "" {
+			segs = append(segs, segment{kind: segText, text: text, line: textLine})
+		}
+		if i == len(tags) {
+			break
+		}
+		t := tags[i]
+		textLine = t.line + strings.Count(t.content, "\n")
+		switch t.kind {
+		case '{':
+			segs = append(segs, segment{kind: segOutput, text: t.content, line: t.line})
+		case '%':
+			segs = append(segs, segment{kind: segStatement, text: t.content, line: t.line})
+		}
+	}
+	return segs, nil
+}
+
+// tagStart returns the index of the first {{, {% or {# in s, -1 if there is
+// none.
+func tagStart(s string) int {
+	for i := 0; i+1 < len(s); i++ {
+		if s[i] == '{' && (s[i+1] == '{' || s[i+1] == '%' || s[i+1] == '#') {
+			return i
+		}
+	}
+	return -1
+}
+
+// tagEnd returns the index of closing in src, starting at pos. With
+// skipStrings, closing is ignored within string literals.
+func tagEnd(src string, pos int, closing string, skipStrings bool) int {
+	for i := pos; i+1 < len(src); i++ {
+		c := src[i]
+		if skipStrings && (c == '\'' || c == '"') {
+			for i++; i < len(src) && src[i] != c; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			continue
+		}
+		if src[i:i+2] == closing {
+			return i
+		}
+	}
+	return -1
+}
+
+// lstripBlock removes spaces and tabs ending text, if they start a line.
+func lstripBlock(text string, atStart bool) string {
+	k := len(text)
+	for k > 0 && (text[k-1] == ' ' || text[k-1] == '\t') {
+		k--
+	}
+	if (k == 0 && atStart) || (k > 0 && text[k-1] == '\n') {
+		return text[:k]
+	}
+	return text
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokString
+	tokInt
+	tokFloat
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+}
+
+var operators = []string{
+	"==", "!=", "<=", ">=", "//", "**",
+	"+", "-", "*", "/", "%", "~", "(", ")", "[", "]", "{", "}", ",", ".", ":", "|", "=", "<", ">",
+}
+
+// tokenize splits the content of a tag into tokens.
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || isLetter(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || isLetter(s[j]) || isDigit(s[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokName, s[i:j]})
+			i = j
+		case isDigit(c):
+			j := i + 1
+			for j < len(s) && (isDigit(s[j]) || s[j] == '_') {
+				j++
+			}
+			kind := tokInt
+			if j+1 < len(s) && s[j] == '.' && isDigit(s[j+1]) {
+				kind = tokFloat
+				for j++; j < len(s) && isDigit(s[j]); j++ {
+				}
+			}
+			if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+				k := j + 1
+				if k < len(s) && (s[k] == '+' || s[k] == '-') {
+					k++
+				}
+				if k < len(s) && isDigit(s[k]) {
+					kind = tokFloat
+					for j = k; j < len(s) && isDigit(s[j]); j++ {
+					}
+				}
+			}
+			tokens = append(tokens, token{kind, strings.ReplaceAll(s[i:j], "_", "")})
+			i = j
+		case c == '\'' || c == '"':
+			str, n, err := unquote(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokString, str})
+			i += n
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, token{tokOp, op})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+// unquote decodes the string literal starting s and returns its length.
+func unquote(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == quote {
+			return b.String(), i + 1, nil
+		}
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		case 'u':
+			var r rune
+			if i+4 < len(s) {
+				if _, err := fmt.Sscanf(s[i+1:i+5], "%04x", &r); err == nil {
+					b.WriteRune(r)
+					i += 4
+					continue
+				}
+			}
+			b.WriteString(`\u`)
+		case '\\', '\'', '"':
+			b.WriteByte(s[i])
+		case '\n':
+			// line continuation
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,795 @@
+package jinja
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type node interface{}
+
+type textNode string
+
+type outputNode struct {
+	e expr
+}
+
+type ifNode struct {
+	conds  []expr
+	bodies [][]node
+	els    []node
+}
+
+type forNode struct {
+	targets []string
+	iter    expr
+	filter  expr
+	body    []node
+	els     []node
+}
+
+type setNode struct {
+	name  string
+	attr  string // set for namespace attributes, {% set ns.attr = ... %}
+	value expr   // nil for block assignments
+	body  []node
+}
+
+type macroNode struct {
+	name     string
+	params   []string
+	defaults []expr
+	body     []node
+}
+
+type breakNode struct{}
+
+type continueNode struct{}
+
+type expr interface{}
+
+type literal struct{ v interface{} }
+
+type nameExpr struct{ name string }
+
+type listExpr struct{ items []expr }
+
+type dictExpr struct{ keys, values []expr }
+
+type attrExpr struct {
+	obj  expr
+	name string
+}
+
+type indexExpr struct{ obj, index expr }
+
+type sliceExpr struct{ obj, start, stop, step expr }
+
+type kwarg struct {
+	name string
+	e    expr
+}
+
+type callExpr struct {
+	fn     expr
+	args   []expr
+	kwargs []kwarg
+}
+
+type filterExpr struct {
+	e      expr
+	name   string
+	args   []expr
+	kwargs []kwarg
+}
+
+type testExpr struct {
+	e      expr
+	name   string
+	args   []expr
+	negate bool
+}
+
+type unaryExpr struct {
+	op string
+	e  expr
+}
+
+type binaryExpr struct {
+	op   string
+	l, r expr
+}
+
+type condExpr struct{ cond, then, els expr }
+
+type parser struct {
+	segs []segment
+	pos  int
+}
+
+// statement is a parsed {% keyword ... %} ending a body.
+type statement struct {
+	keyword string
+	ts      *tokenStream
+	line    int
+}
+
+// parseBody parses nodes up to a statement with one of the keywords ends,
+// which is returned. At the end of the template, the statement is nil.
+func (p *parser) parseBody(ends ...string) ([]node, *statement, error) {
+	var body []node
+	for p.pos < len(p.segs) {
+		seg := p.segs[p.pos]
+		p.pos++
+		switch seg.kind {
+		case segText:
+			body = append(body, textNode(seg.text))
+		case segOutput:
+			ts, err := newTokenStream(seg)
+			if err != nil {
+				return nil, nil, err
+			}
+			e, err := ts.parseExpr()
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := ts.expectEnd(); err != nil {
+				return nil, nil, err
+			}
+			body = append(body, outputNode{e})
+		case segStatement:
+			ts, err := newTokenStream(seg)
+			if err != nil {
+				return nil, nil, err
+			}
+			keyword := ts.next()
+			if keyword.kind != tokName {
+				return nil, nil, ts.errorf("expected statement")
+			}
+			for _, end := range ends {
+				if keyword.val == end {
+					return body, &statement{keyword.val, ts, seg.line}, nil
+				}
+			}
+			n, err := p.parseStatement(keyword.val, ts)
+			if err != nil {
+				return nil, nil, err
+			}
+			if nodes, ok := n.([]node); ok {
+				body = append(body, nodes...)
+			} else {
+				body = append(body, n)
+			}
+		}
+	}
+	if len(ends) > 0 {
+		return nil, nil, fmt.Errorf("missing %s", ends[len(ends)-1])
+	}
+	return body, nil, nil
+}
+
+func (p *parser) parseStatement(keyword string, ts *tokenStream) (node, error) {
+	switch keyword {
+	case "if":
+		return p.parseIf(ts)
+	case "for":
+		return p.parseFor(ts)
+	case "set":
+		return p.parseSet(ts)
+	case "macro":
+		return p.parseMacro(ts)
+	case "break", "continue":
+		if err := ts.expectEnd(); err != nil {
+			return nil, err
+		}
+		if keyword == "break" {
+			return breakNode{}, nil
+		}
+		return continueNode{}, nil
+	case "generation":
+		// marks assistant output for training masks, renders its body
+		if err := ts.expectEnd(); err != nil {
+			return nil, err
+		}
+		body, _, err := p.parseBody("endgeneration")
+		return body, err
+	}
+	return nil, ts.errorf("unsupported statement %s", keyword)
+}
+
+func (p *parser) parseIf(ts *tokenStream) (node, error) {
+	n := ifNode{}
+	for {
+		cond, err := ts.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := ts.expectEnd(); err != nil {
+			return nil, err
+		}
+		body, end, err := p.parseBody("elif", "else", "endif")
+		if err != nil {
+			return nil, err
+		}
+		n.conds = append(n.conds, cond)
+		n.bodies = append(n.bodies, body)
+		switch end.keyword {
+		case "elif":
+			ts = end.ts
+			continue
+		case "else":
+			if err := end.ts.expectEnd(); err != nil {
+				return nil, err
+			}
+			if n.els, end, err = p.parseBody("endif"); err != nil {
+				return nil, err
+			}
+		}
+		return n, end.ts.expectEnd()
+	}
+}
+
+func (p *parser) parseFor(ts *tokenStream) (node, error) {
+	n := forNode{}
+	parens := ts.acceptOp("(")
+	for {
+		name, err := ts.expectName()
+		if err != nil {
+			return nil, err
+		}
+		n.targets = append(n.targets, name)
+		if !ts.acceptOp(",") {
+			break
+		}
+	}
+	if parens {
+		if err := ts.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+	if !ts.acceptName("in") {
+		return nil, ts.errorf("expected in")
+	}
+	var err error
+	if n.iter, err = ts.parseOr(); err != nil {
+		return nil, err
+	}
+	if ts.acceptName("if") {
+		if n.filter, err = ts.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if err := ts.expectEnd(); err != nil {
+		return nil, err
+	}
+	body, end, err := p.parseBody("else", "endfor")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	if end.keyword == "else" {
+		if err := end.ts.expectEnd(); err != nil {
+			return nil, err
+		}
+		if n.els, end, err = p.parseBody("endfor"); err != nil {
+			return nil, err
+		}
+	}
+	return n, end.ts.expectEnd()
+}
+
+func (p *parser) parseSet(ts *tokenStream) (node, error) {
+	name, err := ts.expectName()
+	if err != nil {
+		return nil, err
+	}
+	n := setNode{name: name}
+	if ts.acceptOp(".") {
+		if n.attr, err = ts.expectName(); err != nil {
+			return nil, err
+		}
+	}
+	if ts.acceptOp("=") {
+		if n.value, err = ts.parseExpr(); err != nil {
+			return nil, err
+		}
+		return n, ts.expectEnd()
+	}
+	if err := ts.expectEnd(); err != nil {
+		return nil, err
+	}
+	body, end, err := p.parseBody("endset")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	return n, end.ts.expectEnd()
+}
+
+func (p *parser) parseMacro(ts *tokenStream) (node, error) {
+	name, err := ts.expectName()
+	if err != nil {
+		return nil, err
+	}
+	n := macroNode{name: name}
+	if err := ts.expectOp("("); err != nil {
+		return nil, err
+	}
+	for !ts.acceptOp(")") {
+		param, err := ts.expectName()
+		if err != nil {
+			return nil, err
+		}
+		var def expr
+		if ts.acceptOp("=") {
+			if def, err = ts.parseExpr(); err != nil {
+				return nil, err
+			}
+		}
+		n.params = append(n.params, param)
+		n.defaults = append(n.defaults, def)
+		if !ts.acceptOp(",") {
+			if err := ts.expectOp(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if err := ts.expectEnd(); err != nil {
+		return nil, err
+	}
+	body, end, err := p.parseBody("endmacro")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	return n, end.ts.expectEnd()
+}
+
+// tokenStream parses the expressions of a tag.
+type tokenStream struct {
+	tokens []token
+	pos    int
+	line   int
+}
+
+func newTokenStream(seg segment) (*tokenStream, error) {
+	tokens, err := tokenize(seg.text)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", seg.line, err)
+	}
+	return &tokenStream{tokens: tokens, line: seg.line}, nil
+}
+
+func (ts *tokenStream) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", ts.line, fmt.Sprintf(format, args...))
+}
+
+func (ts *tokenStream) peek() token {
+	return ts.tokens[ts.pos]
+}
+
+func (ts *tokenStream) next() token {
+	t := ts.tokens[ts.pos]
+	if t.kind != tokEOF {
+		ts.pos++
+	}
+	return t
+}
+
+func (ts *tokenStream) acceptOp(op string) bool {
+	if t := ts.peek(); t.kind == tokOp && t.val == op {
+		ts.pos++
+		return true
+	}
+	return false
+}
+
+func (ts *tokenStream) acceptName(name string) bool {
+	if t := ts.peek(); t.kind == tokName && t.val == name {
+		ts.pos++
+		return true
+	}
+	return false
+}
+
+func (ts *tokenStream) expectOp(op string) error {
+	if !ts.acceptOp(op) {
+		return ts.errorf("expected %s, got %q", op, ts.peek().val)
+	}
+	return nil
+}
+
+func (ts *tokenStream) expectName() (string, error) {
+	t := ts.next()
+	if t.kind != tokName {
+		return "", ts.errorf("expected name, got %q", t.val)
+	}
+	return t.val, nil
+}
+
+func (ts *tokenStream) expectEnd() error {
+	if t := ts.peek(); t.kind != tokEOF {
+		return ts.errorf("unexpected %q", t.val)
+	}
+	return nil
+}
+
+func (ts *tokenStream) parseExpr() (expr, error) {
+	e, err := ts.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !ts.acceptName("if") {
+		return e, nil
+	}
+	cond, err := ts.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	var els expr
+	if ts.acceptName("else") {
+		if els, err = ts.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return condExpr{cond, e, els}, nil
+}
+
+func (ts *tokenStream) parseOr() (expr, error) {
+	l, err := ts.parseAnd()
+	for err == nil && ts.acceptName("or") {
+		var r expr
+		r, err = ts.parseAnd()
+		l = binaryExpr{"or", l, r}
+	}
+	return l, err
+}
+
+func (ts *tokenStream) parseAnd() (expr, error) {
+	l, err := ts.parseNot()
+	for err == nil && ts.acceptName("and") {
+		var r expr
+		r, err = ts.parseNot()
+		l = binaryExpr{"and", l, r}
+	}
+	return l, err
+}
+
+func (ts *tokenStream) parseNot() (expr, error) {
+	if ts.acceptName("not") {
+		e, err := ts.parseNot()
+		return unaryExpr{"not", e}, err
+	}
+	return ts.parseCompare()
+}
+
+func (ts *tokenStream) parseCompare() (expr, error) {
+	l, err := ts.parseMath1()
+	for err == nil {
+		t := ts.peek()
+		op := ""
+		switch {
+		case t.kind == tokOp && (t.val == "==" || t.val == "!=" || t.val == "<" ||
+			t.val == ">" || t.val == "<=" || t.val == ">="):
+			op = t.val
+			ts.pos++
+		case t.kind == tokName && t.val == "in":
+			op = "in"
+			ts.pos++
+		case t.kind == tokName && t.val == "not" &&
+			ts.tokens[ts.pos+1].kind == tokName && ts.tokens[ts.pos+1].val == "in":
+			op = "not in"
+			ts.pos += 2
+		default:
+			return l, nil
+		}
+		var r expr
+		r, err = ts.parseMath1()
+		l = binaryExpr{op, l, r}
+	}
+	return l, err
+}
+
+// parseBinary parses left associative operators ops with operands parsed by
+// operand.
+func (ts *tokenStream) parseBinary(operand func() (expr, error), ops ...string) (expr, error) {
+	l, err := operand()
+	for err == nil {
+		t := ts.peek()
+		matched := false
+		for _, op := range ops {
+			if t.kind == tokOp && t.val == op {
+				matched = true
+			}
+		}
+		if !matched {
+			return l, nil
+		}
+		ts.pos++
+		var r expr
+		r, err = operand()
+		l = binaryExpr{t.val, l, r}
+	}
+	return l, err
+}
+
+func (ts *tokenStream) parseMath1() (expr, error) {
+	return ts.parseBinary(ts.parseConcat, "+", "-")
+}
+
+func (ts *tokenStream) parseConcat() (expr, error) {
+	return ts.parseBinary(ts.parseMath2, "~")
+}
+
+func (ts *tokenStream) parseMath2() (expr, error) {
+	return ts.parseBinary(ts.parsePow, "*", "/", "//", "%")
+}
+
+func (ts *tokenStream) parsePow() (expr, error) {
+	return ts.parseBinary(ts.parseUnary, "**")
+}
+
+func (ts *tokenStream) parseUnary() (expr, error) {
+	var e expr
+	var err error
+	if ts.acceptOp("-") {
+		e, err = ts.parseUnary()
+		e = unaryExpr{"-", e}
+	} else if ts.acceptOp("+") {
+		e, err = ts.parseUnary()
+	} else {
+		e, err = ts.parsePrimary()
+		if err == nil {
+			e, err = ts.parsePostfix(e)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ts.parseFilters(e)
+}
+
+func (ts *tokenStream) parsePrimary() (expr, error) {
+	t := ts.next()
+	switch t.kind {
+	case tokName:
+		switch t.val {
+		case "true", "True":
+			return literal{true}, nil
+		case "false", "False":
+			return literal{false}, nil
+		case "none", "None":
+			return literal{nil}, nil
+		}
+		return nameExpr{t.val}, nil
+	case tokString:
+		s := t.val
+		for ts.peek().kind == tokString {
+			s += ts.next().val
+		}
+		return literal{s}, nil
+	case tokInt:
+		i, err := strconv.Atoi(t.val)
+		if err != nil {
+			return nil, ts.errorf("invalid integer %s", t.val)
+		}
+		return literal{i}, nil
+	case tokFloat:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, ts.errorf("invalid float %s", t.val)
+		}
+		return literal{f}, nil
+	case tokOp:
+		switch t.val {
+		case "(":
+			if ts.acceptOp(")") {
+				return listExpr{}, nil
+			}
+			e, err := ts.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if ts.peek().val != "," {
+				return e, ts.expectOp(")")
+			}
+			// tuples are lists
+			items := []expr{e}
+			for ts.acceptOp(",") && ts.peek().val != ")" {
+				e, err := ts.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, e)
+			}
+			return listExpr{items}, ts.expectOp(")")
+		case "[":
+			var items []expr
+			for !ts.acceptOp("]") {
+				e, err := ts.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, e)
+				if !ts.acceptOp(",") {
+					if err := ts.expectOp("]"); err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			return listExpr{items}, nil
+		case "{":
+			d := dictExpr{}
+			for !ts.acceptOp("}") {
+				k, err := ts.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				if err := ts.expectOp(":"); err != nil {
+					return nil, err
+				}
+				v, err := ts.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				d.keys = append(d.keys, k)
+				d.values = append(d.values, v)
+				if !ts.acceptOp(",") {
+					if err := ts.expectOp("}"); err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			return d, nil
+		}
+	}
+	if t.kind == tokEOF {
+		return nil, ts.errorf("unexpected end of expression")
+	}
+	return nil, ts.errorf("unexpected %q", t.val)
+}
+
+func (ts *tokenStream) parsePostfix(e expr) (expr, error) {
+	for {
+		switch {
+		case ts.acceptOp("."):
+			t := ts.next()
+			if t.kind != tokName && t.kind != tokInt {
+				return nil, ts.errorf("expected attribute, got %q", t.val)
+			}
+			if t.kind == tokInt {
+				i, _ := strconv.Atoi(t.val)
+				e = indexExpr{e, literal{i}}
+			} else {
+				e = attrExpr{e, t.val}
+			}
+		case ts.acceptOp("["):
+			var parts [3]expr
+			isSlice := false
+			for i := 0; i < 3; i++ {
+				if t := ts.peek(); !(t.kind == tokOp && (t.val == ":" || t.val == "]")) {
+					part, err := ts.parseExpr()
+					if err != nil {
+						return nil, err
+					}
+					parts[i] = part
+				}
+				if i == 2 || !ts.acceptOp(":") {
+					break
+				}
+				isSlice = true
+			}
+			if err := ts.expectOp("]"); err != nil {
+				return nil, err
+			}
+			if isSlice {
+				e = sliceExpr{e, parts[0], parts[1], parts[2]}
+			} else {
+				e = indexExpr{e, parts[0]}
+			}
+		case ts.acceptOp("("):
+			args, kwargs, err := ts.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = callExpr{e, args, kwargs}
+		default:
+			return e, nil
+		}
+	}
+}
+
+// parseArgs parses call arguments after the opening parenthesis.
+func (ts *tokenStream) parseArgs() ([]expr, []kwarg, error) {
+	var args []expr
+	var kwargs []kwarg
+	for !ts.acceptOp(")") {
+		if t := ts.peek(); t.kind == tokName && ts.tokens[ts.pos+1].kind == tokOp &&
+			ts.tokens[ts.pos+1].val == "=" {
+			ts.pos += 2
+			e, err := ts.parseExpr()
+			if err != nil {
+				return nil, nil, err
+			}
+			kwargs = append(kwargs, kwarg{t.val, e})
+		} else {
+			e, err := ts.parseExpr()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, e)
+		}
+		if !ts.acceptOp(",") {
+			if err := ts.expectOp(")"); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+	return args, kwargs, nil
+}
+
+func (ts *tokenStream) parseFilters(e expr) (expr, error) {
+	for {
+		if ts.acceptOp("|") {
+			name, err := ts.expectName()
+			if err != nil {
+				return nil, err
+			}
+			f := filterExpr{e: e, name: name}
+			if ts.acceptOp("(") {
+				if f.args, f.kwargs, err = ts.parseArgs(); err != nil {
+					return nil, err
+				}
+			}
+			e = f
+			continue
+		}
+		if ts.acceptName("is") {
+			t := testExpr{e: e, negate: ts.acceptName("not")}
+			name := ts.next()
+			if name.kind != tokName {
+				return nil, ts.errorf("expected test name, got %q", name.val)
+			}
+			t.name = name.val
+			if ts.acceptOp("(") {
+				args, _, err := ts.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				t.args = args
+			} else if ts.testArgFollows() {
+				arg, err := ts.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				if arg, err = ts.parsePostfix(arg); err != nil {
+					return nil, err
+				}
+				t.args = []expr{arg}
+			}
+			e = t
+			continue
+		}
+		return e, nil
+	}
+}
+
+// testArgFollows reports whether a test is followed by an argument without
+// parentheses, as in "is divisibleby 3".
+func (ts *tokenStream) testArgFollows() bool {
+	t := ts.peek()
+	switch t.kind {
+	case tokString, tokInt, tokFloat:
+		return true
+	case tokName:
+		switch t.val {
+		case "and", "or", "else", "if", "not", "in", "is":
+			return false
+		}
+		return true
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"log/slog"
 	"net/http"
 
 	"github.com/discovertomorrow/progai-middleware/pkg/handler"
@@ -31,7 +32,7 @@ func handleLlamacpp(
 	enc := json.NewEncoder(&buf)
 	enc.SetEscapeHTML(false)
 	if err := enc.Encode(req); err != nil {
-		l.Info("Error encoding request", err)
+		l.Info("Error encoding request", "error", err)
 		return err
 	}
 
@@ -42,19 +43,41 @@ func handleLlamacpp(
 		bytes.NewBuffer(buf.Bytes()),
 	)
 	if err != nil {
-		l.Error("Error creating request", err)
+		l.Error("Error creating request", "error", err)
 		return err
 	}
 	backendReq.Header.Set("Content-Type", "application/json")
 
 	if err := handler.RequestBackend(
 		backendReq,
-		yield,
+		func(line []byte) bool {
+			logPromptCache(l, slot, line)
+			return yield(line)
+		},
 		lineByLine,
 	); err != nil {
-		l.Error("Error doing request", err)
+		l.Error("Error doing request", "error", err)
 		return err
 	}
 
 	return nil
 }
+
+// logPromptCache logs the prompt cache statistics of the final llama.cpp
+// response line, to measure the effect of slot affinity.
+func logPromptCache(l *slog.Logger, slot Slot, line []byte) {
+	if !bytes.Contains(line, []byte(`"tokens_cached"`)) {
+		return
+	}
+	var r LlamaResponse
+	if err := json.Unmarshal(bytes.TrimPrefix(line, []byte("data: ")), &r); err != nil || !r.Stop {
+		return
+	}
+	l.Info(
+		"Prompt cache",
+		"tokensCached", r.TokensCached,
+		"tokensEvaluated", r.TokensEvaluated,
+		"promptN", r.Timings.PromptN,
+		"prefixMatch", slot.prefixMatch,
+	)
+}
@@ -16,10 +16,55 @@ func writeChatCompletionResponse(
 	model string,
 	msg openai.ChatCompletionMessage,
 	finish_reason *string,
+	logprobs *openai.Logprobs,
 	delta bool,
-	usage bool,
+	includeUsageInStream bool,
+	usage *openai.ChatResponseUsage,
+) error {
+	cr := createChatCompletionResponse(
+		stream, llamacppRequestId, model, msg, finish_reason, logprobs, delta, includeUsageInStream, usage)
+	return writeChatCompletion(w, stream, cr)
+}
+
+// writeToolCallStream streams the tool calls of msg as OpenAI chunks: a role
+// delta, the arguments of each tool call and a final chunk with
+// finish_reason.
+func writeToolCallStream(
+	w http.ResponseWriter,
+	llamacppRequestId string,
+	model string,
+	msg openai.ChatCompletionMessage,
+	finish_reason *string,
+	includeUsage bool,
+	usage *openai.ChatResponseUsage,
 ) error {
-	cr := createChatCompletionResponse(stream, llamacppRequestId, model, msg, finish_reason, delta, usage)
+	deltas := []openai.ChatCompletionDelta{{Role: msg.Role}}
+	for i, tc := range msg.ToolCalls {
+		deltas = append(deltas,
+			openai.ChatCompletionDelta{ToolCalls: []openai.ToolCallDelta{{
+				Index:    i,
+				Id:       tc.Id,
+				Type:     tc.Type,
+				Function: openai.ChatCompletionFunctionDelta{Name: tc.Function.Name},
+			}}},
+			openai.ChatCompletionDelta{ToolCalls: []openai.ToolCallDelta{{
+				Index:    i,
+				Function: openai.ChatCompletionFunctionDelta{Arguments: tc.Function.Arguments},
+			}}},
+		)
+	}
+	for _, delta := range deltas {
+		cr := createChatCompletionChunk(llamacppRequestId, model, delta, nil, nil, includeUsage, nil)
+		if err := writeChatCompletion(w, true, cr); err != nil {
+			return err
+		}
+	}
+	cr := createChatCompletionChunk(
+		llamacppRequestId, model, openai.EmptyDelta{}, finish_reason, nil, includeUsage, usage)
+	return writeChatCompletion(w, true, cr)
+}
+
+func writeChatCompletion(w http.ResponseWriter, stream bool, cr interface{}) error {
 	buf := bytes.Buffer{}
 	enc := json.NewEncoder(&buf)
 	enc.SetEscapeHTML(false)
@@ -43,61 +88,83 @@ func createChatCompletionResponse(
 	model string,
 	msg openai.ChatCompletionMessage,
 	finish_reason *string,
+	logprobs *openai.Logprobs,
 	delta bool,
 	includeUsageInStream bool,
+	usage *openai.ChatResponseUsage,
 ) interface{} {
-	var cr interface{}
-
 	if stream {
 		var deltaContent interface{} = openai.EmptyDelta{}
 		if delta {
 			deltaContent = msg
 		}
-		res := openai.StreamChatResponse{
-			Id:      llamacppRequestId,
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   model,
-			Choices: []openai.StreamChatResponseChoice{
-				{Delta: deltaContent, FinishReason: finish_reason},
-			},
-		}
-		cr = res
-		if includeUsageInStream {
-			var usage *openai.ChatResponseUsage
-			if finish_reason != nil {
-				usage = &openai.ChatResponseUsage{} // TODO: real usage
-			}
-			cr = openai.StreamChatResponseWithUsage{StreamChatResponse: res, Usage: usage}
-		}
-	} else {
-		cr = openai.ChatResponse{
-			Id:      llamacppRequestId,
-			Object:  "chat.completion",
-			Created: time.Now().Unix(),
-			Model:   model,
-			Choices: []openai.ChatResponseChoice{
-				{
-					Message:      msg,
-					FinishReason: finish_reason,
-				},
+		return createChatCompletionChunk(
+			llamacppRequestId, model, deltaContent, finish_reason, logprobs, includeUsageInStream, usage)
+	}
+	res := openai.ChatResponse{
+		Id:      llamacppRequestId,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []openai.ChatResponseChoice{
+			{
+				Message:      msg,
+				Logprobs:     logprobs,
+				FinishReason: finish_reason,
 			},
+		},
+	}
+	if usage != nil {
+		res.Usage = *usage
+	}
+	return res
+}
+
+// createChatCompletionChunk creates a streamed chunk with delta and the
+// logprobs of its tokens. With includeUsage, the final chunk, the one with a
+// finish_reason, carries the usage.
+func createChatCompletionChunk(
+	llamacppRequestId string,
+	model string,
+	delta interface{},
+	finish_reason *string,
+	logprobs *openai.Logprobs,
+	includeUsage bool,
+	usage *openai.ChatResponseUsage,
+) interface{} {
+	res := openai.StreamChatResponse{
+		Id:      llamacppRequestId,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []openai.StreamChatResponseChoice{
+			{Delta: delta, Logprobs: logprobs, FinishReason: finish_reason},
+		},
+	}
+	if !includeUsage {
+		return res
+	}
+	var streamUsage *openai.ChatResponseUsage
+	if finish_reason != nil {
+		streamUsage = &openai.ChatResponseUsage{}
+		if usage != nil {
+			streamUsage = usage
 		}
 	}
-	return cr
+	return openai.StreamChatResponseWithUsage{StreamChatResponse: res, Usage: streamUsage}
 }
 
-// extracts content and finish_reason
-func extractFromLlamaLine(line []byte) (string, *string, error) {
+// extracts content, finish_reason and, on the final line, usage
+func extractFromLlamaLine(line []byte) (string, *string, *openai.ChatResponseUsage, error) {
 	// remove "data: " prefix
 	data := bytes.TrimPrefix(line, []byte{100, 97, 116, 97, 58, 32})
 	if len(data) < 2 {
-		return "", nil, nil
+		return "", nil, nil, nil
 	}
 	var r LlamaResponse
 	err := json.Unmarshal(data, &r)
 	if err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
 	var finish_reason *string
 	if r.StoppedEos || r.StoppedWord {
@@ -107,5 +174,26 @@ func extractFromLlamaLine(line []byte) (string, *string, error) {
 		reason := "length"
 		finish_reason = &reason
 	}
-	return r.Content, finish_reason, nil
+	return r.Content, finish_reason, usageFromLlamaResponse(r), nil
+}
+
+// usageFromLlamaResponse returns the token usage llama.cpp reports on the
+// final response, nil for other responses. Prompt tokens llama.cpp did not
+// have to process were taken from its prompt cache.
+func usageFromLlamaResponse(r LlamaResponse) *openai.ChatResponseUsage {
+	if !r.Stop {
+		return nil
+	}
+	completionTokens := r.Timings.PredictedN
+	if completionTokens == 0 {
+		completionTokens = r.TokensPredicted
+	}
+	return &openai.ChatResponseUsage{
+		PromptTokens:     r.TokensEvaluated,
+		CompletionTokens: completionTokens,
+		TotalTokens:      r.TokensEvaluated + completionTokens,
+		PromptTokensDetails: &openai.PromptTokensDetails{
+			CachedTokens: max(r.TokensEvaluated-r.Timings.PromptN, 0),
+		},
+	}
 }
@@ -0,0 +1,69 @@
+package llamacpp
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+func TestWriteToolCallStream(t *testing.T) {
+	msg, finishReason := createToolChatcompletionMessage([]toolCall{
+		{name: "weather", arguments: `{"city":"Berlin"}`},
+		{name: "weather", arguments: `{"city":"Paris"}`},
+	})
+	usage := &openai.ChatResponseUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}
+	w := httptest.NewRecorder()
+	if err := writeToolCallStream(w, "id", "model", msg, finishReason, true, usage); err != nil {
+		t.Fatalf("writing tool call stream: %v", err)
+	}
+
+	type chunk struct {
+		Choices []struct {
+			Delta        openai.ChatCompletionDelta `json:"delta"`
+			FinishReason *string                    `json:"finish_reason"`
+		} `json:"choices"`
+		Usage *openai.ChatResponseUsage `json:"usage"`
+	}
+	var chunks []chunk
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		var c chunk
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &c); err != nil {
+			t.Fatalf("decoding chunk %s: %v", line, err)
+		}
+		chunks = append(chunks, c)
+	}
+	if len(chunks) != 6 {
+		t.Fatalf("expected 6 chunks; got %d", len(chunks))
+	}
+	if role := chunks[0].Choices[0].Delta.Role; role != "assistant" {
+		t.Errorf("expected role delta assistant; got %q", role)
+	}
+	arguments := map[int]string{}
+	for _, c := range chunks[1:5] {
+		for _, tc := range c.Choices[0].Delta.ToolCalls {
+			arguments[tc.Index] += tc.Function.Arguments
+			if tc.Id != "" && tc.Function.Name != "weather" {
+				t.Errorf("expected name weather with id %s; got %q", tc.Id, tc.Function.Name)
+			}
+		}
+		if c.Usage != nil {
+			t.Errorf("expected no usage before the final chunk")
+		}
+	}
+	if arguments[0] != `{"city":"Berlin"}` || arguments[1] != `{"city":"Paris"}` {
+		t.Errorf("unexpected arguments %v", arguments)
+	}
+	last := chunks[5]
+	if reason := last.Choices[0].FinishReason; reason == nil || *reason != "tool_calls" {
+		t.Errorf("expected finish_reason tool_calls; got %v", reason)
+	}
+	if last.Usage == nil || last.Usage.TotalTokens != 15 {
+		t.Errorf("expected usage on the final chunk; got %v", last.Usage)
+	}
+}
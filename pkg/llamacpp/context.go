@@ -0,0 +1,326 @@
+package llamacpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+// TruncationStrategy decides what happens to the middle turns of a
+// conversation that does not fit into the context.
+type TruncationStrategy string
+
+const (
+	// TruncateDrop drops the oldest middle turns.
+	TruncateDrop TruncationStrategy = "drop"
+	// TruncateSummarize replaces the oldest middle turns with a summary
+	// written by the model. If summarizing fails, the turns are dropped.
+	TruncateSummarize TruncationStrategy = "summarize"
+)
+
+// defaultSummaryTokens limits the length of summaries if
+// [ContextBudget.SummaryTokens] is not set.
+const defaultSummaryTokens = 256
+
+// ContextBudget configures how chat requests are fit into the context of a
+// model. The leading system messages and the latest turn, starting with the
+// last user message, are always kept. Requests that do not fit even then are
+// answered with an OpenAI style context_length_exceeded error.
+type ContextBudget struct {
+	// ContextSize in tokens. If 0, the context size discovered with
+	// [WithPropsDiscovery] is used; without it, requests are not budgeted.
+	ContextSize int
+	// CompletionTokens are reserved for the completion of requests without
+	// max_tokens. Requests with max_tokens reserve max_tokens.
+	CompletionTokens int
+	Strategy         TruncationStrategy
+	// SummaryTokens limits the length of summaries, defaults to 256.
+	SummaryTokens int
+}
+
+// WithContextBudget counts the prompt tokens of chat requests with the
+// backend's /tokenize endpoint and truncates conversations exceeding the
+// context according to b.
+func WithContextBudget(b ContextBudget) ChatOption {
+	return func(c *chatConfig) {
+		c.budget = &b
+	}
+}
+
+// contextSizeOf returns the context size of queue to budget with, 0 if
+// unknown or b is nil.
+func (b *ContextBudget) contextSizeOf(queue *Queue) int {
+	if b == nil {
+		return 0
+	}
+	if b.ContextSize > 0 {
+		return b.ContextSize
+	}
+	if props, ok := queue.ModelProps(); ok {
+		return props.ContextSize
+	}
+	return 0
+}
+
+// contextLengthError is returned by fitContext if a conversation does not fit
+// into the context.
+type contextLengthError struct {
+	contextSize int
+	tokens      int
+	completion  int
+}
+
+func (e *contextLengthError) Error() string {
+	if e.completion > 0 {
+		return fmt.Sprintf(
+			"This model's maximum context length is %d tokens. However, you requested %d tokens "+
+				"(%d in the messages, %d in the completion). Please reduce the length of the messages or completion.",
+			e.contextSize, e.tokens+e.completion, e.tokens, e.completion)
+	}
+	return fmt.Sprintf(
+		"This model's maximum context length is %d tokens. However, your messages resulted in %d tokens. "+
+			"Please reduce the length of the messages.",
+		e.contextSize, e.tokens)
+}
+
+// fitContext returns msgs and their prompt, with the oldest middle turns
+// dropped or summarized until the prompt leaves completion tokens of the
+// context for the completion.
+func fitContext(
+	l *slog.Logger,
+	msgs []openai.Message,
+	contextSize int,
+	completion int,
+	strategy TruncationStrategy,
+	summaryTokens int,
+	prepareChatPrompt func([]openai.Message) (string, error),
+	countTokens func(prompt string) (int, error),
+	summarize func([]openai.Message) (string, error),
+) ([]openai.Message, string, error) {
+	measure := func(msgs []openai.Message) (string, int, error) {
+		prompt, err := prepareChatPrompt(msgs)
+		if err != nil {
+			return "", 0, err
+		}
+		n, err := countTokens(prompt)
+		return prompt, n, err
+	}
+
+	limit := contextSize - completion
+	prompt, n, err := measure(msgs)
+	if err != nil || n <= limit {
+		return msgs, prompt, err
+	}
+
+	head, turns, tail := splitTurns(msgs)
+	keep := func(drop int) []openai.Message {
+		kept := append([]openai.Message{}, head...)
+		for _, turn := range turns[drop:] {
+			kept = append(kept, turn...)
+		}
+		return append(kept, tail...)
+	}
+	// fewestDrops returns the fewest turns to drop for a prompt of at most
+	// target tokens, len(turns)+1 if dropping all turns is not enough.
+	// Dropping more turns never grows the prompt.
+	fewestDrops := func(target int) (int, error) {
+		var err error
+		drop := sort.Search(len(turns), func(i int) bool {
+			if err != nil {
+				return true
+			}
+			_, n, measureErr := measure(keep(i + 1))
+			err = measureErr
+			return n <= target
+		})
+		return drop + 1, err
+	}
+
+	drop, err := fewestDrops(limit)
+	if err != nil {
+		return nil, "", err
+	}
+	if drop > len(turns) {
+		_, n, err := measure(keep(len(turns)))
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, "", &contextLengthError{contextSize: contextSize, tokens: n, completion: completion}
+	}
+
+	if strategy == TruncateSummarize {
+		summaryDrop, err := fewestDrops(limit - summaryTokens)
+		if err != nil {
+			return nil, "", err
+		}
+		if summaryDrop <= len(turns) {
+			if summarized, prompt, ok := summarizeTurns(
+				l, keep(summaryDrop), len(head), turns[:summaryDrop], limit, measure, summarize,
+			); ok {
+				l.Info("Summarized conversation", "summarizedTurns", summaryDrop)
+				return summarized, prompt, nil
+			}
+		}
+	}
+
+	l.Info("Truncated conversation", "droppedTurns", drop)
+	kept := keep(drop)
+	prompt, _, err = measure(kept)
+	return kept, prompt, err
+}
+
+// summarizeTurns adds a summary of turns to kept, if it fits into limit.
+func summarizeTurns(
+	l *slog.Logger,
+	kept []openai.Message,
+	head int,
+	turns [][]openai.Message,
+	limit int,
+	measure func([]openai.Message) (string, int, error),
+	summarize func([]openai.Message) (string, error),
+) ([]openai.Message, string, bool) {
+	var dropped []openai.Message
+	for _, turn := range turns {
+		dropped = append(dropped, turn...)
+	}
+	summary, err := summarize(dropped)
+	if err != nil {
+		l.Info("Error summarizing conversation, dropping turns instead", "error", err)
+		return nil, "", false
+	}
+	summarized := withSummary(kept, head, summary)
+	prompt, n, err := measure(summarized)
+	if err != nil || n > limit {
+		l.Info("Summarized conversation does not fit, dropping turns instead", "error", err)
+		return nil, "", false
+	}
+	return summarized, prompt, true
+}
+
+// splitTurns splits msgs into the leading system messages, the turns in
+// between, each starting with a user message, and the latest turn.
+func splitTurns(msgs []openai.Message) (head []openai.Message, turns [][]openai.Message, tail []openai.Message) {
+	start := 0
+	for start < len(msgs) && msgs[start].Role == "system" {
+		start++
+	}
+	end := len(msgs) - 1
+	for end > start && msgs[end].Role != "user" {
+		end--
+	}
+	if end < start {
+		end = start
+	}
+	for _, m := range msgs[start:end] {
+		if m.Role == "user" || len(turns) == 0 {
+			turns = append(turns, nil)
+		}
+		turns[len(turns)-1] = append(turns[len(turns)-1], m)
+	}
+	return msgs[:start], turns, msgs[end:]
+}
+
+// withSummary adds summary to the last of the n leading system messages of
+// msgs, or as a system message if there are none.
+func withSummary(msgs []openai.Message, n int, summary string) []openai.Message {
+	text := "Summary of the earlier conversation: " + summary
+	if n == 0 {
+		return append([]openai.Message{{Role: "system", Content: openai.Content(text)}}, msgs...)
+	}
+	summarized := append([]openai.Message{}, msgs...)
+	summarized[n-1].Content = openai.Content(string(summarized[n-1].Content) + "\n\n" + text)
+	return summarized
+}
+
+// summarizeMessages asks the model for a summary of msgs of at most maxTokens
+// tokens.
+func summarizeMessages(
+	llama func(Request, func([]byte) bool, bool) error,
+	stop []string,
+	prepareChatPrompt func([]openai.Message) (string, error),
+	msgs []openai.Message,
+	maxTokens int,
+) (string, error) {
+	transcript := strings.Builder{}
+	for _, m := range msgs {
+		if m.Content == "" {
+			continue
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n", m.Role, m.Content)
+	}
+	prompt, err := prepareChatPrompt([]openai.Message{{
+		Role: "user",
+		Content: openai.Content(
+			"Summarize the following conversation in a few sentences. Keep facts, names " +
+				"and decisions needed to continue it. Answer with the summary only.\n\n" +
+				transcript.String()),
+	}})
+	if err != nil {
+		return "", err
+	}
+	var temperature float32 = 0.01
+	req := Request{
+		Prompt:      prompt,
+		NPredict:    maxTokens,
+		Temperature: &temperature,
+		Stop:        stop,
+	}
+	summary := strings.Builder{}
+	if err := llama(req, func(line []byte) bool {
+		content, _, _, err := extractFromLlamaLine(line)
+		if err != nil {
+			return false
+		}
+		summary.WriteString(content)
+		return true
+	}, false); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(summary.String()) == "" {
+		return "", errors.New("empty summary")
+	}
+	return strings.TrimSpace(summary.String()), nil
+}
+
+// countTokens counts the tokens of prompt with the /tokenize endpoint of the
+// llama.cpp server serving endpoint.
+func countTokens(ctx context.Context, endpoint string, prompt string) (int, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(map[string]interface{}{"content": prompt, "add_special": true})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, "POST", u.ResolveReference(&url.URL{Path: "/tokenize"}).String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New(resp.Status)
+	}
+	var tokens struct {
+		Tokens []json.RawMessage `json:"tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return 0, err
+	}
+	return len(tokens.Tokens), nil
+}
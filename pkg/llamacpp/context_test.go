@@ -0,0 +1,117 @@
+package llamacpp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+func TestFitContext(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	render := func(msgs []openai.Message) (string, error) {
+		parts := []string{}
+		for _, m := range msgs {
+			parts = append(parts, string(m.Content))
+		}
+		return strings.Join(parts, " "), nil
+	}
+	// every word is a token
+	count := func(prompt string) (int, error) {
+		return len(strings.Fields(prompt)), nil
+	}
+	msgs := []openai.Message{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "one two three and some more words"},
+		{Role: "assistant", Content: "four five"},
+		{Role: "user", Content: "six seven"},
+		{Role: "assistant", Content: "eight"},
+		{Role: "user", Content: "nine ten"},
+	}
+	summarize := func(msgs []openai.Message) (string, error) {
+		return "s", nil
+	}
+	contents := func(msgs []openai.Message) string {
+		s, _ := render(msgs)
+		return s
+	}
+
+	t.Run("Fits", func(t *testing.T) {
+		fitted, prompt, err := fitContext(l, msgs, 17, 0, TruncateDrop, 0, render, count, summarize)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(fitted) != len(msgs) || prompt != contents(msgs) {
+			t.Errorf("expected messages unchanged; got %q", prompt)
+		}
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		fitted, prompt, err := fitContext(l, msgs, 10, 2, TruncateDrop, 0, render, count, summarize)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := "be brief six seven eight nine ten"
+		if prompt != expected || contents(fitted) != expected {
+			t.Errorf("expected %q; got %q", expected, prompt)
+		}
+	})
+
+	t.Run("Summarize", func(t *testing.T) {
+		fitted, prompt, err := fitContext(l, msgs, 13, 0, TruncateSummarize, 6, render, count, summarize)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := "be brief\n\nSummary of the earlier conversation: s six seven eight nine ten"
+		if prompt != expected || contents(fitted) != expected {
+			t.Errorf("expected %q; got %q", expected, prompt)
+		}
+	})
+
+	t.Run("SummarizeFails", func(t *testing.T) {
+		_, prompt, err := fitContext(l, msgs, 10, 0, TruncateSummarize, 4, render, count,
+			func([]openai.Message) (string, error) { return "", errors.New("failed") })
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := "be brief six seven eight nine ten"; prompt != expected {
+			t.Errorf("expected %q; got %q", expected, prompt)
+		}
+	})
+
+	t.Run("Exceeded", func(t *testing.T) {
+		_, _, err := fitContext(l, msgs, 3, 0, TruncateDrop, 0, render, count, summarize)
+		var lengthErr *contextLengthError
+		if !errors.As(err, &lengthErr) {
+			t.Fatalf("expected contextLengthError; got %v", err)
+		}
+		if lengthErr.tokens != 4 {
+			t.Errorf("expected 4 tokens; got %d", lengthErr.tokens)
+		}
+	})
+}
+
+func TestCountTokens(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tokenize" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, `{"tokens":[1,2,3]}`)
+	}))
+	defer server.Close()
+
+	n, err := countTokens(context.Background(), server.URL+"/completion", "Hi")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 tokens; got %d", n)
+	}
+}
@@ -0,0 +1,229 @@
+package llamacpp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+)
+
+var (
+	// ErrEndpointExists is returned when adding an endpoint twice.
+	ErrEndpointExists = errors.New("endpoint already exists")
+	// ErrUnknownEndpoint is returned for endpoints not served by the queue.
+	ErrUnknownEndpoint = errors.New("unknown endpoint")
+	// ErrInvalidParallel is returned for a negative number of slots.
+	ErrInvalidParallel = errors.New("parallel must not be negative")
+)
+
+// AddEndpoint adds the slots of ep to the queue. With [WithHealthCheck], the
+// endpoint is only put into rotation after its health checks succeeded. With
+// [WithPropsDiscovery], its props are fetched.
+func (q *Queue) AddEndpoint(ep handler.Endpoint) error {
+	if ep.Parallel < 0 {
+		return ErrInvalidParallel
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, exists := q.endpoints[ep.Endpoint]; exists {
+		return ErrEndpointExists
+	}
+	q.endpoints[ep.Endpoint] = &queueEndpoint{
+		parallel: ep.Parallel,
+		health:   endpointHealth{healthy: q.healthCheck == nil},
+	}
+	q.addSlots(ep.Endpoint, 0, ep.Parallel)
+	slog.Info("Endpoint added", "endpoint", ep.Endpoint, "parallel", ep.Parallel)
+	if q.propsTimeout > 0 {
+		go q.discoverProps(ep.Endpoint)
+	}
+	q.dispatch()
+	return nil
+}
+
+// RemoveEndpoint takes endpoint out of the queue. New requests are not routed
+// to it anymore, requests in flight finish and release their slots normally.
+func (q *Queue) RemoveEndpoint(endpoint string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, exists := q.endpoints[endpoint]; !exists {
+		return ErrUnknownEndpoint
+	}
+	q.retireSlots(endpoint, 0)
+	delete(q.endpoints, endpoint)
+	slog.Info("Endpoint removed", "endpoint", endpoint)
+	return nil
+}
+
+// ResizeEndpoint changes the number of parallel slots of endpoint. When
+// shrinking, slots in use are retired once they are released.
+func (q *Queue) ResizeEndpoint(endpoint string, parallel int) error {
+	if parallel < 0 {
+		return ErrInvalidParallel
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	ep, exists := q.endpoints[endpoint]
+	if !exists {
+		return ErrUnknownEndpoint
+	}
+	if parallel > ep.parallel {
+		q.addSlots(endpoint, ep.parallel, parallel)
+	} else {
+		q.retireSlots(endpoint, parallel)
+	}
+	slog.Info("Endpoint resized", "endpoint", endpoint, "from", ep.parallel, "to", parallel)
+	ep.parallel = parallel
+	q.dispatch()
+	return nil
+}
+
+// DrainEndpoint stops routing new requests to endpoint and waits until its
+// requests in flight are finished or ctx is done. The endpoint stays drained
+// until [Queue.ResumeEndpoint] is called or it is removed.
+func (q *Queue) DrainEndpoint(ctx context.Context, endpoint string) error {
+	q.mutex.Lock()
+	ep, exists := q.endpoints[endpoint]
+	if !exists {
+		q.mutex.Unlock()
+		return ErrUnknownEndpoint
+	}
+	ep.draining = true
+	q.mutex.Unlock()
+
+	for {
+		q.mutex.Lock()
+		busy := q.inFlight(endpoint)
+		released := q.released
+		q.mutex.Unlock()
+		if busy == 0 {
+			return nil
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ResumeEndpoint puts a drained endpoint back into rotation.
+func (q *Queue) ResumeEndpoint(endpoint string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	ep, exists := q.endpoints[endpoint]
+	if !exists {
+		return ErrUnknownEndpoint
+	}
+	ep.draining = false
+	q.dispatch()
+	return nil
+}
+
+// Drain rejects new and waiting requests with [ErrDraining] and waits until
+// all requests in flight released their slots or ctx is done. The handlers
+// answer rejected requests with 503 and Retry-After.
+//
+// To shut down gracefully, drain the queue before shutting down the server,
+// so streaming completions are not cut off:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+//	defer cancel()
+//	queue.Drain(ctx)
+//	server.Shutdown(ctx)
+func (q *Queue) Drain(ctx context.Context) error {
+	q.drainOnce.Do(func() {
+		close(q.draining)
+	})
+	for {
+		q.mutex.Lock()
+		busy := 0
+		for _, h := range q.holders {
+			if h != nil {
+				busy++
+			}
+		}
+		released := q.released
+		q.mutex.Unlock()
+		if busy == 0 {
+			return nil
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// addSlots adds the slots from to to-1 of endpoint. Retired slots of the same
+// endpoint and slot number are reused, so a slot still in flight is never
+// handed out twice. q.mutex must be held.
+func (q *Queue) addSlots(endpoint string, from, to int) {
+	for j := from; j < to; j++ {
+		if id, ok := q.findSlot(endpoint, j); ok {
+			q.retired[id] = false
+			continue
+		}
+		eps := EndpointSlot{endpoint: endpoint, slot: j}
+		u := &Usage{user: -1, time: int64(rand.Intn(10001)), userSlot: -1}
+		if id, ok := q.reusableSlot(); ok {
+			q.endpointSlots[id] = eps
+			q.slots[id] = u
+			q.retired[id] = false
+			continue
+		}
+		q.endpointSlots = append(q.endpointSlots, eps)
+		q.slots = append(q.slots, u)
+		q.retired = append(q.retired, false)
+		q.holders = append(q.holders, nil)
+		q.n++
+	}
+}
+
+// retireSlots retires the slots of endpoint with a slot number >= from.
+// q.mutex must be held.
+func (q *Queue) retireSlots(endpoint string, from int) {
+	for i := range q.n {
+		eps := q.endpointSlots[i]
+		if eps.endpoint == endpoint && eps.slot >= from {
+			q.retired[i] = true
+		}
+	}
+}
+
+// findSlot returns the id of slot number j of endpoint. q.mutex must be held.
+func (q *Queue) findSlot(endpoint string, j int) (int, bool) {
+	for i := range q.n {
+		eps := q.endpointSlots[i]
+		if eps.endpoint == endpoint && eps.slot == j {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// reusableSlot returns the id of a retired slot that is not in use. q.mutex
+// must be held.
+func (q *Queue) reusableSlot() (int, bool) {
+	for i := range q.n {
+		if q.retired[i] && q.slots[i] != nil {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// inFlight returns the number of slots of endpoint in use. q.mutex must be
+// held.
+func (q *Queue) inFlight(endpoint string) int {
+	n := 0
+	for i := range q.n {
+		if q.slots[i] == nil && q.endpointSlots[i].endpoint == endpoint {
+			n++
+		}
+	}
+	return n
+}
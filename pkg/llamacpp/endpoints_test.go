@@ -0,0 +1,87 @@
+package llamacpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+)
+
+func TestDynamicEndpoints(t *testing.T) {
+	q := NewQueue(
+		[]handler.Endpoint{{Endpoint: "a", Parallel: 1}},
+		WithMaxWait(10*time.Millisecond),
+	)
+	ctx := context.Background()
+
+	inFlight, err := q.RequestSlotContext(ctx, 1, -1)
+	if err != nil || inFlight.endpointSlot.endpoint != "a" {
+		t.Fatalf("expected slot on a; got %v %v", inFlight.endpointSlot, err)
+	}
+
+	if err := q.AddEndpoint(handler.Endpoint{Endpoint: "b", Parallel: 2}); err != nil {
+		t.Fatalf("adding endpoint: %v", err)
+	}
+	if err := q.AddEndpoint(handler.Endpoint{Endpoint: "b", Parallel: 2}); !errors.Is(err, ErrEndpointExists) {
+		t.Errorf("expected ErrEndpointExists; got %v", err)
+	}
+	if err := q.AddEndpoint(handler.Endpoint{Endpoint: "c", Parallel: -1}); !errors.Is(err, ErrInvalidParallel) {
+		t.Errorf("expected ErrInvalidParallel; got %v", err)
+	}
+	if err := q.ResizeEndpoint("b", -1); !errors.Is(err, ErrInvalidParallel) {
+		t.Errorf("expected ErrInvalidParallel; got %v", err)
+	}
+	if err := q.RemoveEndpoint("a"); err != nil {
+		t.Fatalf("removing endpoint: %v", err)
+	}
+	// the request in flight on a finishes, its slot must not come back
+	q.ReleaseSlot(inFlight)
+
+	var slots []Slot
+	for i := range 2 {
+		s, err := q.RequestSlotContext(ctx, i+2, -1)
+		if err != nil || s.endpointSlot.endpoint != "b" {
+			t.Fatalf("expected slot on b; got %v %v", s.endpointSlot, err)
+		}
+		slots = append(slots, s)
+	}
+	if _, err := q.RequestSlotContext(ctx, 5, -1); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("expected ErrQueueTimeout; got %v", err)
+	}
+
+	// shrink while both slots are in use, then grow again
+	if err := q.ResizeEndpoint("b", 1); err != nil {
+		t.Fatalf("resizing endpoint: %v", err)
+	}
+	q.ReleaseSlot(slots[1])
+	q.ReleaseSlot(slots[0])
+	s, err := q.RequestSlotContext(ctx, 6, -1)
+	if err != nil || s.endpointSlot.slot != 0 {
+		t.Fatalf("expected slot 0 on b; got %v %v", s.endpointSlot, err)
+	}
+	if _, err := q.RequestSlotContext(ctx, 7, -1); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("expected ErrQueueTimeout after shrinking; got %v", err)
+	}
+
+	// draining waits for the request in flight and blocks new ones
+	drained := make(chan error)
+	go func() {
+		drained <- q.DrainEndpoint(ctx, "b")
+	}()
+	time.Sleep(5 * time.Millisecond)
+	q.ReleaseSlot(s)
+	if err := <-drained; err != nil {
+		t.Errorf("draining endpoint: %v", err)
+	}
+	if _, err := q.RequestSlotContext(ctx, 8, -1); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("expected ErrQueueTimeout while drained; got %v", err)
+	}
+	if err := q.ResumeEndpoint("b"); err != nil {
+		t.Fatalf("resuming endpoint: %v", err)
+	}
+	if _, err := q.RequestSlotContext(ctx, 9, -1); err != nil {
+		t.Errorf("expected slot after resume; got %v", err)
+	}
+}
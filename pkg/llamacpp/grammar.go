@@ -0,0 +1,247 @@
+package llamacpp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+// primitive GBNF rules for JSON values, added to a grammar when used
+var grammarPrimitives = map[string]string{
+	"ws":      `" "?`,
+	"string":  `"\"" ( [^"\\\x7F\x00-\x1F] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] ) )* "\""`,
+	"integer": `"-"? ( [0-9] | [1-9] [0-9]* )`,
+	"number":  `"-"? ( [0-9] | [1-9] [0-9]* ) ( "." [0-9]+ )? ( [eE] [-+]? [0-9]+ )?`,
+	"boolean": `"true" | "false"`,
+	"null":    `"null"`,
+	"value":   `object | array | string | number | boolean | null`,
+	"object":  `"{" ws ( string ws ":" ws value ( ws "," ws string ws ":" ws value )* )? ws "}"`,
+	"array":   `"[" ws ( value ( ws "," ws value )* )? ws "]"`,
+}
+
+// primitive rules referenced by other primitive rules
+var grammarPrimitiveDeps = map[string][]string{
+	"value":  {"object", "array", "string", "number", "boolean", "null"},
+	"object": {"ws", "string", "value"},
+	"array":  {"ws", "value"},
+}
+
+// grammarBuilder collects the rules of a GBNF grammar for llama.cpp.
+type grammarBuilder struct {
+	rules map[string]string
+	order []string
+}
+
+func newGrammarBuilder() *grammarBuilder {
+	return &grammarBuilder{rules: make(map[string]string)}
+}
+
+// add adds the rule name ::= def and returns name.
+func (g *grammarBuilder) add(name, def string) string {
+	if _, exists := g.rules[name]; !exists {
+		g.order = append(g.order, name)
+	}
+	g.rules[name] = def
+	return name
+}
+
+// primitive adds the primitive rule name and its dependencies and returns
+// name.
+func (g *grammarBuilder) primitive(name string) string {
+	if _, exists := g.rules[name]; exists {
+		return name
+	}
+	g.add(name, grammarPrimitives[name])
+	for _, dep := range grammarPrimitiveDeps[name] {
+		g.primitive(dep)
+	}
+	return name
+}
+
+func (g *grammarBuilder) String() string {
+	var b strings.Builder
+	for _, name := range g.order {
+		fmt.Fprintf(&b, "%s ::= %s\n", name, g.rules[name])
+	}
+	return b.String()
+}
+
+// gbnfLiteral quotes s as a GBNF string literal.
+func gbnfLiteral(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// jsonLiteral returns a GBNF literal matching v encoded as JSON.
+func jsonLiteral(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return gbnfLiteral(string(b))
+}
+
+// toolCallGrammar returns a grammar restricting the output to a JSON tool
+// call {"name": ..., "arguments": {...}} of one of tools, with arguments
+// matching the tool's parameters. With parallel, the output is a JSON list of
+// one or more tool calls.
+func toolCallGrammar(tools []openai.Tool, parallel bool) string {
+	g := newGrammarBuilder()
+	root := g.add("root", "")
+	ws := g.primitive("ws")
+	var calls []string
+	for i, tool := range tools {
+		name := fmt.Sprintf("tool-%d", i)
+		args := g.objectRule(name+"-args", tool.Function.Parameters)
+		calls = append(calls, g.add(name, fmt.Sprintf(
+			`"{" %[1]s "\"name\"" %[1]s ":" %[1]s %[2]s %[1]s "," %[1]s "\"arguments\"" %[1]s ":" %[1]s %[3]s %[1]s "}"`,
+			ws, jsonLiteral(tool.Function.Name), args,
+		)))
+	}
+	if !parallel {
+		g.rules[root] = strings.Join(calls, " | ")
+		return g.String()
+	}
+	call := g.add("call", strings.Join(calls, " | "))
+	g.rules[root] = fmt.Sprintf(`"[" %[1]s %[2]s ( %[1]s "," %[1]s %[2]s )* %[1]s "]"`, ws, call)
+	return g.String()
+}
+
+// schemaRule adds the rules for a JSON value matching s and returns the name
+// of its rule. Keywords a grammar cannot enforce, like numeric bounds, are
+// ignored.
+func (g *grammarBuilder) schemaRule(name string, s openai.Schema) string {
+	switch {
+	case s.Bool != nil:
+		return g.primitive("value")
+	case len(s.Const) > 0:
+		return g.add(name, gbnfLiteral(compactJSON(s.Const)))
+	case len(s.Enum) > 0:
+		var values []string
+		for _, v := range s.Enum {
+			values = append(values, jsonLiteral(v))
+		}
+		return g.add(name, strings.Join(values, " | "))
+	case len(s.AnyOf) > 0 || len(s.OneOf) > 0:
+		var alternatives []string
+		for i, alt := range append(s.AnyOf, s.OneOf...) {
+			alternatives = append(alternatives, g.schemaRule(fmt.Sprintf("%s-%d", name, i), alt))
+		}
+		return g.add(name, strings.Join(alternatives, " | "))
+	case len(s.AllOf) == 1:
+		return g.schemaRule(name, s.AllOf[0])
+	}
+
+	types := s.Type
+	if len(types) == 0 {
+		switch {
+		case len(s.Properties) > 0:
+			types = openai.SchemaType{"object"}
+		case s.Items != nil:
+			types = openai.SchemaType{"array"}
+		default:
+			return g.primitive("value")
+		}
+	}
+	var alternatives []string
+	for _, t := range types {
+		switch t {
+		case "object":
+			if len(s.Properties) == 0 {
+				alternatives = append(alternatives, g.primitive("object"))
+			} else {
+				alternatives = append(alternatives, g.objectRule(name+"-object", s))
+			}
+		case "array":
+			if s.Items == nil {
+				alternatives = append(alternatives, g.primitive("array"))
+			} else {
+				alternatives = append(alternatives, g.arrayRule(name+"-array", s))
+			}
+		case "string", "integer", "number", "boolean", "null":
+			alternatives = append(alternatives, g.primitive(t))
+		default:
+			alternatives = append(alternatives, g.primitive("value"))
+		}
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0]
+	}
+	return g.add(name, strings.Join(alternatives, " | "))
+}
+
+// objectRule adds the rules for an object with the properties of s and
+// returns the name of its rule. Required properties come first in a fixed
+// order, optional ones may follow. An object without properties is empty,
+// unless s allows additional properties.
+func (g *grammarBuilder) objectRule(name string, s openai.Schema) string {
+	ws := g.primitive("ws")
+	if len(s.Properties) == 0 && s.AdditionalProperties != nil &&
+		(s.AdditionalProperties.Bool == nil || *s.AdditionalProperties.Bool) {
+		return g.primitive("object")
+	}
+	var required, optional []string
+	keys := make([]string, 0, len(s.Properties))
+	for key := range s.Properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		value := g.schemaRule(fmt.Sprintf("%s-%d-value", name, i), s.Properties[key])
+		kv := g.add(
+			fmt.Sprintf("%s-%d", name, i),
+			fmt.Sprintf(`%s %s ":" %s %s`, jsonLiteral(key), ws, ws, value),
+		)
+		if contains(s.Required, key) {
+			required = append(required, kv)
+		} else {
+			optional = append(optional, kv)
+		}
+	}
+
+	sep := fmt.Sprintf(`%[1]s "," %[1]s`, ws)
+	var body string
+	if len(required) > 0 {
+		body = strings.Join(required, " "+sep+" ")
+		for _, kv := range optional {
+			body += fmt.Sprintf(" ( %s %s )?", sep, kv)
+		}
+	} else if len(optional) > 0 {
+		// any optional property may come first, the later ones may follow
+		var alternatives []string
+		for i, kv := range optional {
+			alt := kv
+			for _, next := range optional[i+1:] {
+				alt += fmt.Sprintf(" ( %s %s )?", sep, next)
+			}
+			alternatives = append(alternatives, alt)
+		}
+		body = fmt.Sprintf("( %s )?", strings.Join(alternatives, " | "))
+	}
+	if body == "" {
+		return g.add(name, fmt.Sprintf(`"{" %s "}"`, ws))
+	}
+	return g.add(name, fmt.Sprintf(`"{" %[1]s %[2]s %[1]s "}"`, ws, body))
+}
+
+// arrayRule adds the rules for an array of s.Items and returns the name of
+// its rule.
+func (g *grammarBuilder) arrayRule(name string, s openai.Schema) string {
+	ws := g.primitive("ws")
+	item := g.schemaRule(name+"-item", *s.Items)
+	items := fmt.Sprintf(`%[1]s ( %[2]s "," %[2]s %[1]s )*`, item, ws)
+	if s.MinItems == nil || *s.MinItems == 0 {
+		items = fmt.Sprintf("( %s )?", items)
+	}
+	return g.add(name, fmt.Sprintf(`"[" %[1]s %[2]s %[1]s "]"`, ws, items))
+}
+
+// compactJSON returns raw without insignificant whitespace.
+func compactJSON(raw json.RawMessage) string {
+	buf := bytes.Buffer{}
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
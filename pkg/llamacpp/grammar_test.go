@@ -0,0 +1,130 @@
+package llamacpp
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+func TestToolCallGrammar(t *testing.T) {
+	tools := []openai.Tool{
+		{Function: openai.Function{
+			Name: "height",
+			Parameters: openai.Parameters{
+				Type:     openai.SchemaType{"object"},
+				Required: []string{"building"},
+				Properties: map[string]openai.Property{
+					"building": {Type: openai.SchemaType{"string"}},
+					"unit":     {Type: openai.SchemaType{"string"}, Enum: []interface{}{"m", "ft"}},
+				},
+			},
+		}},
+		{Function: openai.Function{Name: "now"}},
+	}
+	grammar := toolCallGrammar(tools, false)
+	for _, rule := range []string{
+		`root ::= tool-0 | tool-1`,
+		`tool-0-args ::= "{" ws tool-0-args-0 ( ws "," ws tool-0-args-1 )? ws "}"`,
+		`tool-0-args-1-value ::= "\"m\"" | "\"ft\""`,
+		`tool-1 ::= "{" ws "\"name\"" ws ":" ws "\"now\"" ws "," ws "\"arguments\"" ws ":" ws tool-1-args ws "}"`,
+		`tool-1-args ::= "{" ws "}"`,
+	} {
+		if !strings.Contains(grammar, rule+"\n") {
+			t.Errorf("expected rule %s in grammar:\n%s", rule, grammar)
+		}
+	}
+}
+
+func TestParseToolCall(t *testing.T) {
+	calls, err := parseToolCalls(
+		`{"name": "search", "arguments": {"query": "say \"hi\", then \"bye\"", "filter": {"tags": ["a", "b"]}, "limit": 1.5}}`,
+	)
+	if err != nil {
+		t.Fatalf("parsing tool call: %v", err)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 tool call; got %d", len(calls))
+	}
+	if calls[0].name != "search" {
+		t.Errorf("expected name search; got %s", calls[0].name)
+	}
+	expected := `{"query":"say \"hi\", then \"bye\"","filter":{"tags":["a","b"]},"limit":1.5}`
+	if calls[0].arguments != expected {
+		t.Errorf("expected arguments %s; got %s", expected, calls[0].arguments)
+	}
+}
+
+func TestParseParallelToolCalls(t *testing.T) {
+	calls, err := parseToolCalls(
+		`[{"name": "height", "arguments": {"building": "Empire State Building"}}, {"name": "now", "arguments": {}}]`,
+	)
+	if err != nil {
+		t.Fatalf("parsing tool calls: %v", err)
+	}
+	expected := []toolCall{
+		{name: "height", arguments: `{"building":"Empire State Building"}`},
+		{name: "now", arguments: `{}`},
+	}
+	if len(calls) != len(expected) {
+		t.Fatalf("expected %d tool calls; got %d", len(expected), len(calls))
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Errorf("expected tool call %v; got %v", expected[i], calls[i])
+		}
+	}
+
+	msg, _ := createToolChatcompletionMessage(calls)
+	if msg.ToolCalls[0].Id == msg.ToolCalls[1].Id {
+		t.Errorf("expected unique tool call ids; got %s twice", msg.ToolCalls[0].Id)
+	}
+}
+
+func TestToolCallGrammarParallel(t *testing.T) {
+	tools := []openai.Tool{
+		{Function: openai.Function{Name: "now"}},
+		{Function: openai.Function{Name: "today"}},
+	}
+	grammar := toolCallGrammar(tools, true)
+	for _, rule := range []string{
+		`root ::= "[" ws call ( ws "," ws call )* ws "]"`,
+		`call ::= tool-0 | tool-1`,
+	} {
+		if !strings.Contains(grammar, rule+"\n") {
+			t.Errorf("expected rule %s in grammar:\n%s", rule, grammar)
+		}
+	}
+}
+
+func TestToolCallGrammarNested(t *testing.T) {
+	var params openai.Parameters
+	err := json.Unmarshal([]byte(`{
+  "type": "object",
+  "required": ["filter"],
+  "properties": {
+    "filter": {
+      "type": "object",
+      "required": ["tags"],
+      "properties": {"tags": {"type": "array", "items": {"type": "string"}, "minItems": 1}}
+    },
+    "limit": {"anyOf": [{"type": "integer"}, {"type": "null"}]},
+    "exact": {"type": "boolean"}
+  }
+}`), &params)
+	if err != nil {
+		t.Fatalf("decoding parameters: %v", err)
+	}
+	grammar := toolCallGrammar([]openai.Tool{{Function: openai.Function{Name: "search", Parameters: params}}}, false)
+	for _, rule := range []string{
+		`tool-0-args ::= "{" ws tool-0-args-1 ( ws "," ws tool-0-args-0 )? ( ws "," ws tool-0-args-2 )? ws "}"`,
+		`tool-0-args-1-value-object-0-value-array ::= "[" ws string ( ws "," ws string )* ws "]"`,
+		`tool-0-args-2-value ::= integer | null`,
+		`tool-0-args-0 ::= "\"exact\"" ws ":" ws boolean`,
+	} {
+		if !strings.Contains(grammar, rule+"\n") {
+			t.Errorf("expected rule %s in grammar:\n%s", rule, grammar)
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package llamacpp
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+	"github.com/discovertomorrow/progai-middleware/pkg/session"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -211,3 +219,359 @@ func TestNewLlamacppChatHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestLlamacppModelRouter(t *testing.T) {
+	mockHandle := new(MockHandleFunc)
+	registry := NewModelRegistry()
+	for _, m := range []Model{
+		{
+			Name:         "mistral",
+			Aliases:      []string{"gpt-4o"},
+			Queue:        NewQueue([]handler.Endpoint{{Endpoint: "http://mistral:8080", Parallel: 1}}),
+			ChatTemplate: `{{ range . }}[INST] {{ .Content }} [/INST]{{ end }}`,
+		},
+		{
+			Name:         "zephyr",
+			Queue:        NewQueue([]handler.Endpoint{{Endpoint: "http://zephyr:8080", Parallel: 1}}),
+			ChatTemplate: `{{ range . }}<|{{ .Role }}|>{{ .Content }}{{ end }}`,
+		},
+	} {
+		if err := registry.Register(m); err != nil {
+			t.Fatalf("registering model: %v", err)
+		}
+	}
+	queue := NewQueue([]handler.Endpoint{{Endpoint: "http://other:8080", Parallel: 1}})
+	if err := registry.Register(Model{Name: "gpt-4o", Queue: queue}); !errors.Is(err, ErrModelExists) {
+		t.Errorf("expected error registering an existing alias; got %v", err)
+	}
+	if err := registry.Register(Model{Name: "other"}); err == nil {
+		t.Errorf("expected error registering a model without queue")
+	}
+	if err := registry.Register(Model{Queue: queue}); err == nil {
+		t.Errorf("expected error registering a model without name")
+	}
+
+	handler := newChatHandler(slog.Default(), true, mockHandle.Handle, registry.chatModel)
+
+	t.Run("Alias", func(t *testing.T) {
+		mockHandle.On(
+			"Handle",
+			mock.Anything,
+			mock.MatchedBy(func(slot Slot) bool {
+				return slot.endpointSlot.endpoint == "http://mistral:8080"
+			}),
+			mock.MatchedBy(func(req Request) bool {
+				return req.Prompt == "[INST] Hello! [/INST]"
+			}),
+			mock.Anything,
+			mock.Anything,
+		).Return(nil).Once()
+
+		reqBody := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello!"}]}`
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(reqBody)))
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status OK; got %v", w.Code)
+		}
+		mockHandle.AssertExpectations(t)
+	})
+
+	t.Run("UnknownModel", func(t *testing.T) {
+		reqBody := `{"model": "llama", "messages": [{"role": "user", "content": "Hello!"}]}`
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(reqBody)))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404; got %v", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), `"code":"model_not_found"`) {
+			t.Errorf("expected model_not_found error; got %s", w.Body.String())
+		}
+	})
+
+	t.Run("ModelList", func(t *testing.T) {
+		// the session allows the alias by the model's name, like the router
+		ctx := session.WithToken(context.Background(), session.SessionData{AllowedModels: []string{"mistral"}})
+		w := httptest.NewRecorder()
+		openai.NewModelsHandler(registry.OpenAIModels, true).ServeHTTP(
+			w, httptest.NewRequest("GET", "/v1/models", nil).WithContext(ctx))
+		var list openai.ModelList
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatalf("decoding models: %v", err)
+		}
+		var ids []string
+		for _, m := range list.Data {
+			ids = append(ids, m.Id)
+			if m.Created == 0 {
+				t.Errorf("expected %s to default to its registration time", m.Id)
+			}
+		}
+		if strings.Join(ids, ",") != "mistral,gpt-4o" {
+			t.Errorf("expected mistral and its alias gpt-4o; got %v", ids)
+		}
+	})
+}
+
+func TestLlamacppChatHandlerUsage(t *testing.T) {
+	mockHandle, endpoints := setup()
+	handler := newLlamacppChatHandlerInternal(
+		slog.Default(),
+		false,
+		`{{ range . }}{{ .Content }}{{ end }}`,
+		nil,
+		mockHandle.Handle,
+		NewQueue(endpoints),
+	)
+	mockHandle.On(
+		"Handle",
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+	).Run(func(args mock.Arguments) {
+		writeLine := args.Get(3).(func([]byte) bool)
+		writeLine([]byte(`{"content":"Hi!","stop":true,"stopped_eos":true,` +
+			`"tokens_cached":12,"tokens_evaluated":10,"tokens_predicted":3,` +
+			`"timings":{"prompt_n":4,"predicted_n":3}}`))
+	}).Return(nil)
+
+	reqBody := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello!"}]}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(reqBody)))
+
+	var resp openai.ChatResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	u := resp.Usage
+	if u.PromptTokens != 10 || u.CompletionTokens != 3 || u.TotalTokens != 13 ||
+		u.PromptTokensDetails == nil || u.PromptTokensDetails.CachedTokens != 6 {
+		t.Errorf("unexpected usage %+v", u)
+	}
+}
+
+func TestLlamacppModelHandlerLogitBias(t *testing.T) {
+	mockHandle, endpoints := setup()
+	handler := newModelHandler(
+		slog.Default(),
+		false,
+		Model{
+			ChatTemplate:          `{{ range . }}{{ .Content }}{{ end }}`,
+			Queue:                 NewQueue(endpoints),
+			LogitBias:             [][2]float64{{13, -100}},
+			ToolDecisionLogitBias: [][2]float64{{382, -0.3}},
+		},
+		mockHandle.Handle,
+	)
+	var reqs []Request
+	mockHandle.On(
+		"Handle",
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+	).Run(func(args mock.Arguments) {
+		reqs = append(reqs, args.Get(2).(Request))
+		writeLine := args.Get(3).(func([]byte) bool)
+		writeLine([]byte(`{"content":"NOT HELPFUL","stop":true}`))
+	}).Return(nil)
+
+	reqBody := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello!"}],
+"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}]}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(reqBody)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("expected the tool decision and the completion request; got %d requests", len(reqs))
+	}
+	if decision := reqs[0]; decision.NPredict != 1 ||
+		len(decision.LogitBias) != 1 || decision.LogitBias[0] != [2]float64{382, -0.3} {
+		t.Errorf("expected the tool decision with the model's bias; got %+v", decision)
+	}
+	if completion := reqs[1]; len(completion.LogitBias) != 1 || completion.LogitBias[0] != [2]float64{13, -100} {
+		t.Errorf("expected the model's logit bias; got %v", completion.LogitBias)
+	}
+}
+
+func TestLlamacppChatHandlerToolCallTurns(t *testing.T) {
+	source, err := os.ReadFile(filepath.Join("testdata", "templates", "mistral.jinja"))
+	if err != nil {
+		t.Fatalf("reading template: %v", err)
+	}
+	mockHandle, endpoints := setup()
+	handler := newModelHandler(
+		slog.Default(),
+		false,
+		Model{JinjaTemplate: string(source), EOSToken: "</s>", Queue: NewQueue(endpoints)},
+		mockHandle.Handle,
+	)
+
+	mockHandle.On(
+		"Handle",
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+	).Run(func(args mock.Arguments) {
+		writeLine := args.Get(3).(func([]byte) bool)
+		writeLine([]byte(`{"content":"{\"name\": \"weather\", \"arguments\": {\"city\": \"Berlin\"}}","stop":true}`))
+	}).Return(nil).Once()
+	reqBody := `{"model": "mistral", "messages": [{"role": "user", "content": "Weather in Berlin?"}],
+"tools": [{"type": "function", "function": {"name": "weather", "parameters": {"type": "object"}}}],
+"tool_choice": {"type": "function", "function": {"name": "weather"}}}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(reqBody)))
+	var resp openai.ChatResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(resp.Choices) != 1 || len(resp.Choices[0].Message.ToolCalls) != 1 {
+		t.Fatalf("expected a tool call; got %+v", resp)
+	}
+	call := resp.Choices[0].Message.ToolCalls[0]
+
+	// the template accepts the generated id in the next turn
+	mockHandle.On(
+		"Handle",
+		mock.Anything,
+		mock.Anything,
+		mock.MatchedBy(func(req Request) bool {
+			return strings.Contains(req.Prompt, `"id": "`+call.Id+`"}]</s>`) &&
+				strings.Contains(req.Prompt, `"call_id": "`+call.Id+`"}[/TOOL_RESULTS]`)
+		}),
+		mock.Anything,
+		mock.Anything,
+	).Run(func(args mock.Arguments) {
+		writeLine := args.Get(3).(func([]byte) bool)
+		writeLine([]byte(`{"content":"It is sunny.","stop":true}`))
+	}).Return(nil).Once()
+	next, err := json.Marshal(map[string]interface{}{
+		"model": "mistral",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": "Weather in Berlin?"},
+			map[string]interface{}{"role": "assistant", "tool_calls": []openai.ToolCall{call}},
+			map[string]interface{}{"role": "tool", "tool_call_id": call.Id, "content": `{"weather": "sunny"}`},
+		},
+	})
+	if err != nil {
+		t.Fatalf("encoding request: %v", err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader(next)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body)
+	}
+	mockHandle.AssertExpectations(t)
+}
+
+func TestLlamacppChatHandlerNoParallelToolCalls(t *testing.T) {
+	source, err := os.ReadFile(filepath.Join("testdata", "templates", "llama3.jinja"))
+	if err != nil {
+		t.Fatalf("reading template: %v", err)
+	}
+	mockHandle, endpoints := setup()
+	handler := newModelHandler(
+		slog.Default(),
+		false,
+		Model{JinjaTemplate: string(source), Queue: NewQueue(endpoints), NoParallelToolCalls: true},
+		mockHandle.Handle,
+	)
+
+	// the grammar allows a single call only, although the request allows
+	// parallel calls
+	mockHandle.On(
+		"Handle",
+		mock.Anything,
+		mock.Anything,
+		mock.MatchedBy(func(req Request) bool {
+			return req.Grammar != nil && !strings.HasPrefix(*req.Grammar, `root ::= "["`)
+		}),
+		mock.Anything,
+		mock.Anything,
+	).Run(func(args mock.Arguments) {
+		writeLine := args.Get(3).(func([]byte) bool)
+		writeLine([]byte(`{"content":"{\"name\": \"weather\", \"arguments\": {\"city\": \"Berlin\"}}","stop":true}`))
+	}).Return(nil).Once()
+	reqBody := `{"model": "llama3", "messages": [{"role": "user", "content": "Weather in Berlin?"}],
+"tools": [{"type": "function", "function": {"name": "weather", "parameters": {"type": "object"}}}],
+"tool_choice": "required", "parallel_tool_calls": true}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(reqBody)))
+	var resp openai.ChatResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(resp.Choices) != 1 || len(resp.Choices[0].Message.ToolCalls) != 1 {
+		t.Fatalf("expected a tool call; got %+v", resp)
+	}
+	call := resp.Choices[0].Message.ToolCalls[0]
+
+	// the template accepts the tool call in the next turn
+	mockHandle.On(
+		"Handle",
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+	).Run(func(args mock.Arguments) {
+		writeLine := args.Get(3).(func([]byte) bool)
+		writeLine([]byte(`{"content":"It is sunny.","stop":true}`))
+	}).Return(nil).Once()
+	next, err := json.Marshal(map[string]interface{}{
+		"model": "llama3",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": "Weather in Berlin?"},
+			map[string]interface{}{"role": "assistant", "tool_calls": []openai.ToolCall{call}},
+			map[string]interface{}{"role": "tool", "tool_call_id": call.Id, "content": `{"weather": "sunny"}`},
+		},
+	})
+	if err != nil {
+		t.Fatalf("encoding request: %v", err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader(next)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body)
+	}
+	mockHandle.AssertExpectations(t)
+}
+
+func TestLlamacppChatHandlerPromptErrors(t *testing.T) {
+	mockHandle, endpoints := setup()
+	discovering := NewQueue(endpoints, WithPropsDiscovery(time.Millisecond))
+	defer discovering.Close()
+	for name, tc := range map[string]struct {
+		model  Model
+		status int
+	}{
+		"NotDiscovered": {Model{Queue: discovering}, http.StatusServiceUnavailable},
+		"Exception": {
+			Model{JinjaTemplate: `{{ raise_exception('no system messages') }}`, Queue: NewQueue(endpoints)},
+			http.StatusBadRequest,
+		},
+		"TemplateBug": {
+			Model{JinjaTemplate: `{{ messages | unknown }}`, Queue: NewQueue(endpoints)},
+			http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			handler := newModelHandler(slog.Default(), false, tc.model, mockHandle.Handle)
+			reqBody := `{"model": "m", "messages": [{"role": "user", "content": "Hello!"}]}`
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(reqBody)))
+			if w.Code != tc.status {
+				t.Errorf("expected status %d; got %d: %s", tc.status, w.Code, w.Body)
+			}
+			if tc.status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+				t.Errorf("expected Retry-After")
+			}
+		})
+	}
+	mockHandle.AssertNotCalled(t, "Handle", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
@@ -1,15 +1,18 @@
 package llamacpp
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"strconv"
-	"text/template"
 	"time"
 
 	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+	"github.com/discovertomorrow/progai-middleware/pkg/jinja"
 	"github.com/discovertomorrow/progai-middleware/pkg/logging"
 	"github.com/discovertomorrow/progai-middleware/pkg/openai"
 	"github.com/discovertomorrow/progai-middleware/pkg/session"
@@ -18,11 +21,25 @@ import (
 func NewLlamacppHandler(
 	lineByLine bool,
 	endpoints []handler.Endpoint,
+	opts ...QueueOption,
 ) http.Handler {
 	return newLlamacppHandlerInternal(
 		lineByLine,
 		handleLlamacpp,
-		NewQueue(endpoints),
+		NewQueue(endpoints, opts...),
+	)
+}
+
+// NewLlamacppQueueHandler is like [NewLlamacppHandler] but serves requests
+// from queue, so the queue can be shared, inspected and managed at runtime.
+func NewLlamacppQueueHandler(
+	lineByLine bool,
+	queue *Queue,
+) http.Handler {
+	return newLlamacppHandlerInternal(
+		lineByLine,
+		handleLlamacpp,
+		queue,
 	)
 }
 
@@ -30,6 +47,7 @@ func newLlamacppHandlerInternal(
 	lineByLine bool,
 	handle handleFunc,
 	queue *Queue,
+	opts ...ChatOption,
 ) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -40,7 +58,7 @@ func newLlamacppHandlerInternal(
 		var req Request
 		err := dec.Decode(&req)
 		if err != nil {
-			l.Info("Error unmarshaling Body", err)
+			l.Info("Error unmarshaling Body", "error", err)
 			http.Error(w, "error unmarshaling request", http.StatusBadRequest)
 			return
 		}
@@ -56,7 +74,13 @@ func newLlamacppHandlerInternal(
 			return
 		}
 
-		slot := queue.RequestSlot(session.SessionIdFromContext(ctx), req.Slot)
+		slot, err := queue.RequestSlotContext(
+			slotContext(r, req.Prompt), session.SessionIdFromContext(ctx), req.Slot)
+		if err != nil {
+			l.Info("Error requesting slot", "error", err)
+			writeQueueError(w, queue, err)
+			return
+		}
 		defer queue.ReleaseSlot(slot)
 		l = l.With(
 			"slot", slot.ID,
@@ -64,7 +88,7 @@ func newLlamacppHandlerInternal(
 			"endpointSlot", slot.endpointSlot.slot,
 			"endpoint", slot.endpointSlot.endpoint,
 		)
-		l.Info("Got slot")
+		l.Info("Got slot", "prefixMatch", slot.prefixMatch)
 
 		w.Header().Set("Content-Type", "application/json")
 
@@ -75,7 +99,7 @@ func newLlamacppHandlerInternal(
 			func(line []byte) bool {
 				_, err := w.Write(line)
 				if err != nil {
-					l.Info("Error writing line", err)
+					l.Info("Error writing line", "error", err)
 					return false
 				}
 				flusher.Flush()
@@ -83,19 +107,26 @@ func newLlamacppHandlerInternal(
 			},
 			lineByLine,
 		); err != nil {
-			http.Error(w, "Error requesting response", http.StatusInternalServerError)
+			if isBackendFailure(ctx, err) {
+				queue.ReportFailure(slot)
+			}
+			writeBackendError(w, err)
 		}
 
 		l.Info("Finished Response")
 	})
 }
 
+// NewLlamacppChatHandler serves chat requests from endpoints with the Go
+// template chatTemplate. Use [NewLlamacppModelHandler] to configure the model
+// further, e.g. with logit biases.
 func NewLlamacppChatHandler(
 	logger *slog.Logger,
 	lineByLine bool,
 	endpoints []handler.Endpoint,
 	chatTemplate string,
 	stop []string,
+	opts ...QueueOption,
 ) http.Handler {
 	return newLlamacppChatHandlerInternal(
 		logger,
@@ -103,10 +134,41 @@ func NewLlamacppChatHandler(
 		chatTemplate,
 		stop,
 		handleLlamacpp,
-		NewQueue(endpoints),
+		NewQueue(endpoints, opts...),
 	)
 }
 
+// NewLlamacppChatQueueHandler is like [NewLlamacppChatHandler] but serves
+// requests from queue, so the queue can be shared, inspected and managed at
+// runtime.
+func NewLlamacppChatQueueHandler(
+	logger *slog.Logger,
+	lineByLine bool,
+	queue *Queue,
+	chatTemplate string,
+	stop []string,
+	opts ...ChatOption,
+) http.Handler {
+	return newLlamacppChatHandlerInternal(
+		logger,
+		lineByLine,
+		chatTemplate,
+		stop,
+		handleLlamacpp,
+		queue,
+		opts...,
+	)
+}
+
+// ChatOption configures the llama.cpp chat handlers.
+type ChatOption func(*chatConfig)
+
+type chatConfig struct {
+	toolCalls ToolCallStore
+	budget    *ContextBudget
+	images    *ImageLimits
+}
+
 func newLlamacppChatHandlerInternal(
 	logger *slog.Logger,
 	lineByLine bool,
@@ -114,24 +176,89 @@ func newLlamacppChatHandlerInternal(
 	stop []string,
 	handle handleFunc,
 	queue *Queue,
+	opts ...ChatOption,
 ) http.Handler {
-	logger.Warn("LlamacppChatHandler is experimental")
-	tmpl, err := template.New("chat").Parse(chatTemplate)
+	return newModelHandler(
+		logger,
+		lineByLine,
+		Model{ChatTemplate: chatTemplate, Stop: stop, Queue: queue},
+		handle,
+		opts...,
+	)
+}
+
+// NewLlamacppModelHandler serves chat requests for the single model m,
+// regardless of the request's model field. Unlike [NewLlamacppChatHandler],
+// all settings of [Model] apply, like presets, Jinja templates and logit
+// biases. It panics if the template of m cannot be parsed.
+func NewLlamacppModelHandler(
+	logger *slog.Logger,
+	lineByLine bool,
+	m Model,
+	opts ...ChatOption,
+) http.Handler {
+	return newModelHandler(logger, lineByLine, m, handleLlamacpp, opts...)
+}
+
+func newModelHandler(
+	logger *slog.Logger,
+	lineByLine bool,
+	m Model,
+	handle handleFunc,
+	opts ...ChatOption,
+) http.Handler {
+	cm, err := newChatModel(m)
 	if err != nil {
-		logger.Error("Error parsing template", err)
+		logger.Error("Error parsing template", "error", err)
 		// we cannot recover from this
 		panic(err)
 	}
-	prepareChatPrompt := func(msgs []openai.Message) (string, error) {
-		buf := bytes.Buffer{}
-		tmpl.Execute(&buf, msgs)
-		if err != nil {
-			return "", err
-		}
-		return buf.String(), err
-	}
+	return newChatHandler(
+		logger,
+		lineByLine,
+		handle,
+		func(string) (*chatModel, bool) { return cm, true },
+		opts...,
+	)
+}
 
-	toolCalls := NewExpiringMap()
+// NewLlamacppModelRouter serves chat requests for all models of registry,
+// routed by the request's model field. Unknown models are answered with an
+// OpenAI style 404 error.
+func NewLlamacppModelRouter(
+	logger *slog.Logger,
+	lineByLine bool,
+	registry *ModelRegistry,
+	opts ...ChatOption,
+) http.Handler {
+	return newChatHandler(logger, lineByLine, handleLlamacpp, registry.chatModel, opts...)
+}
+
+func newChatHandler(
+	logger *slog.Logger,
+	lineByLine bool,
+	handle handleFunc,
+	resolveModel func(name string) (*chatModel, bool),
+	opts ...ChatOption,
+) http.Handler {
+	logger.Warn("LlamacppChatHandler is experimental")
+
+	var cfg chatConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	toolCalls := cfg.toolCalls
+	if toolCalls == nil {
+		toolCalls = NewMemoryToolCallStore(DefaultToolCallTTL)
+	}
+	budget := cfg.budget
+	imageLimits := DefaultImageLimits
+	if cfg.images != nil {
+		imageLimits = *cfg.images
+	}
+	if budget != nil && budget.SummaryTokens == 0 {
+		budget.SummaryTokens = defaultSummaryTokens
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -143,7 +270,7 @@ func newLlamacppChatHandlerInternal(
 		var chatReq openai.ChatRequest
 		err := dec.Decode(&chatReq)
 		if err != nil {
-			l.Info("Error unmarshaling Body", err)
+			l.Info("Error unmarshaling Body", "error", err)
 			http.Error(w, "error unmarshaling request", http.StatusBadRequest)
 			return
 		}
@@ -153,6 +280,37 @@ func newLlamacppChatHandlerInternal(
 			return
 		}
 
+		cm, ok := resolveModel(chatReq.Model)
+		if s, hasSession := session.FromContext(ctx); ok && hasSession && cm.name != "" &&
+			!s.ModelAllowed(chatReq.Model) && !s.ModelAllowed(cm.name) {
+			// models the token may not use are reported as not existing
+			ok = false
+		}
+		if !ok {
+			l.Info("Unknown model", "model", chatReq.Model)
+			openai.WriteError(
+				w, http.StatusNotFound,
+				fmt.Sprintf("The model `%s` does not exist", chatReq.Model),
+				"invalid_request_error", "model", "model_not_found",
+			)
+			return
+		}
+		if chatReq.User != "" {
+			l = l.With("user", chatReq.User)
+		}
+		cm.applyDefaults(&chatReq)
+		owner := toolCallOwner(ctx)
+		chatReq.Messages = restoreToolCalls(l, chatReq.Messages, toolCalls, owner)
+		messages, images, err := extractImages(chatReq.Messages, imageLimits)
+		if err != nil {
+			l.Info("Invalid images", "error", err)
+			writeParamError(w, err)
+			return
+		}
+		chatReq.Messages = messages
+		queue := cm.queue
+		prepareChatPrompt := cm.prepareChatPrompt
+
 		streamIncludeUsage := false
 		if chatReq.StreamOptions != nil {
 			if value, ok := (*chatReq.StreamOptions)["include_usage"]; ok {
@@ -172,26 +330,34 @@ func newLlamacppChatHandlerInternal(
 
 		prompt, err := prepareChatPrompt(chatReq.Messages)
 		if err != nil {
-			l.Info("Error preparing prompt", err)
-			http.Error(w, "bad request (messages)", http.StatusBadRequest)
+			l.Info("Error preparing prompt", "error", err)
+			writePromptError(w, err)
 			return
 		}
 
 		stream := chatReq.Stream
 		model := chatReq.Model
 
-		req := Request{
-			Prompt:      prompt,
-			Stream:      stream,
-			NPredict:    chatReq.MaxTokens,
-			Temperature: chatReq.Temperature,
-			TopP:        chatReq.TopP,
-			CachePrompt: true,
-			Stop:        stop,
-			LogitBias:   [][2]float64{{523, -10.0}, {28789, -10.0}, {6647, -10.0}},
+		req, err := cm.completionRequest(chatReq, prompt)
+		if err != nil {
+			l.Info("Invalid request parameter", "error", err)
+			writeParamError(w, err)
+			return
+		}
+		req.ImageData = images
+		stop := req.Stop
+		topLogprobs := 0
+		if chatReq.TopLogprobs != nil {
+			topLogprobs = *chatReq.TopLogprobs
 		}
 
-		slot := queue.RequestSlot(session.SessionIdFromContext(ctx), req.Slot)
+		slot, err := queue.RequestSlotContext(
+			slotContext(r, req.Prompt), session.SessionIdFromContext(ctx), req.Slot)
+		if err != nil {
+			l.Info("Error requesting slot", "error", err)
+			writeQueueError(w, queue, err)
+			return
+		}
 		defer queue.ReleaseSlot(slot)
 		l = l.With(
 			"slot", slot.ID,
@@ -199,41 +365,92 @@ func newLlamacppChatHandlerInternal(
 			"endpointSlot", slot.endpointSlot.slot,
 			"endpoint", slot.endpointSlot.endpoint,
 		)
-		l.Info("Got slot")
+		l.Info("Got slot", "prefixMatch", slot.prefixMatch)
 
 		llama := func(req Request, yield func([]byte) bool, stream bool) error {
-			return handle(ctx, slot, req, yield, stream)
+			err := handle(ctx, slot, req, yield, stream)
+			if err != nil && isBackendFailure(ctx, err) {
+				queue.ReportFailure(slot)
+			}
+			return err
+		}
+
+		if contextSize := budget.contextSizeOf(queue); contextSize > 0 {
+			completion := chatReq.MaxTokens
+			if completion <= 0 {
+				completion = budget.CompletionTokens
+			}
+			msgs, prompt, err := fitContext(
+				l, chatReq.Messages, contextSize, completion, budget.Strategy, budget.SummaryTokens,
+				prepareChatPrompt,
+				func(prompt string) (int, error) {
+					return countTokens(ctx, slot.endpointSlot.endpoint, prompt)
+				},
+				func(msgs []openai.Message) (string, error) {
+					return summarizeMessages(llama, stop, prepareChatPrompt, msgs, budget.SummaryTokens)
+				},
+			)
+			var lengthErr *contextLengthError
+			switch {
+			case errors.As(err, &lengthErr):
+				l.Info("Context length exceeded", "error", err)
+				openai.WriteError(
+					w, http.StatusBadRequest, lengthErr.Error(),
+					"invalid_request_error", "messages", "context_length_exceeded")
+				return
+			case err != nil:
+				// serve the request untruncated rather than failing it
+				l.Warn("Error fitting conversation into context", "error", err)
+			default:
+				chatReq.Messages = msgs
+				req.Prompt = prompt
+			}
 		}
 
 		active, err := handleTools(
-			w, llama, stream, llamacppRequestId, model, stop, l, chatReq, toolCalls, prepareChatPrompt)
+			w, llama, stream, streamIncludeUsage, llamacppRequestId, model, stop, cm.toolDecisionBias, l,
+			chatReq, toolCalls, owner, prepareChatPrompt)
 		if err != nil {
-			l.Error("Error in handleTools", err)
+			l.Error("Error in handleTools", "error", err)
 		}
 		if active {
 			// Return on active. Response has already been served by handleTools.
 			return
 		}
 
+		if schema := strictSchema(chatReq.ResponseFormat); schema != nil {
+			serveStrict(w, llama, l, req, *schema, stream, streamIncludeUsage, llamacppRequestId, model)
+			l.Info("Finished Response")
+			return
+		}
+
 		if err := llama(
 			req,
 			func(line []byte) bool {
-				content, finish_reason, err := extractFromLlamaLine(line)
+				content, finish_reason, usage, err := extractFromLlamaLine(line)
 				if err != nil {
-					l.Error("Error parsing Llama.cpp response", err)
+					l.Error("Error parsing Llama.cpp response", "error", err)
 					http.Error(w, "Error parsing Llama.cpp response", http.StatusInternalServerError)
 					return false
 				}
+				var logprobs *openai.Logprobs
+				if chatReq.Logprobs {
+					if logprobs, err = logprobsFromLlamaLine(line, topLogprobs); err != nil {
+						l.Warn("Error parsing Llama.cpp probabilities", "error", err)
+					}
+				}
 				delta := len(content) > 0
 				if delta || finish_reason != nil {
 					if err := writeChatCompletionResponse(
 						w, stream, llamacppRequestId, model,
 						openai.ChatCompletionMessage{Role: "assistant", Content: &content},
 						finish_reason,
+						logprobs,
 						delta,
 						streamIncludeUsage,
+						usage,
 					); err != nil {
-						l.Info("Error writing line", err)
+						l.Info("Error writing line", "error", err)
 						return false
 					}
 					flusher.Flush()
@@ -242,7 +459,9 @@ func newLlamacppChatHandlerInternal(
 			},
 			lineByLine,
 		); err != nil {
-			http.Error(w, "Error requesting response", http.StatusInternalServerError)
+			l.Info("Error requesting response", "error", err)
+			writeBackendError(w, err)
+			return
 		}
 
 		if stream {
@@ -251,3 +470,91 @@ func newLlamacppChatHandlerInternal(
 		l.Info("Finished Response")
 	})
 }
+
+// writeBackendError answers a request llama.cpp failed. Client errors of
+// llama.cpp are passed on, an unavailable llama.cpp, e.g. while loading the
+// model, is answered with 503 and other failures with 502.
+func writeBackendError(w http.ResponseWriter, err error) {
+	var status *handler.StatusError
+	if errors.As(err, &status) && status.StatusCode == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(defaultRetryAfter))
+		openai.WriteError(
+			w, http.StatusServiceUnavailable, "The model is not available, try again later.",
+			"server_error", "", "")
+		return
+	}
+	if errors.As(err, &status) && status.StatusCode < 500 {
+		message := status.Body
+		var resp openai.ErrorResponse
+		if json.Unmarshal([]byte(status.Body), &resp) == nil && resp.Error.Message != "" {
+			message = resp.Error.Message
+		}
+		openai.WriteError(w, status.StatusCode, message, "invalid_request_error", "", "")
+		return
+	}
+	openai.WriteError(w, http.StatusBadGateway, "Error requesting response", "server_error", "", "")
+}
+
+// writePromptError answers a request whose prompt could not be rendered. Only
+// conversations the chat template rejects are client errors, other errors
+// are bugs of the template.
+func writePromptError(w http.ResponseWriter, err error) {
+	var exception *jinja.Exception
+	switch {
+	case errors.As(err, &exception):
+		openai.WriteError(
+			w, http.StatusBadRequest, exception.Message,
+			"invalid_request_error", "messages", "")
+	case errors.Is(err, errTemplateNotDiscovered):
+		w.Header().Set("Retry-After", strconv.Itoa(defaultRetryAfter))
+		openai.WriteError(
+			w, http.StatusServiceUnavailable, "The model's chat template is not available yet, try again later.",
+			"server_error", "", "")
+	default:
+		openai.WriteError(
+			w, http.StatusInternalServerError, "Error rendering the chat template.",
+			"server_error", "", "")
+	}
+}
+
+// writeParamError answers a request with an invalid parameter.
+func writeParamError(w http.ResponseWriter, err error) {
+	var invalid *paramError
+	if errors.As(err, &invalid) {
+		openai.WriteError(
+			w, http.StatusBadRequest, invalid.message,
+			"invalid_request_error", invalid.param, "")
+		return
+	}
+	http.Error(w, "bad request", http.StatusBadRequest)
+}
+
+// slotContext returns the context of r with the request's priority and prompt
+// for [Queue.RequestSlotContext].
+func slotContext(r *http.Request, prompt string) context.Context {
+	return WithPrompt(WithPriority(r.Context(), requestPriority(r)), prompt)
+}
+
+// defaultRetryAfter is sent as Retry-After (seconds) if the queue has no
+// maximum wait configured.
+const defaultRetryAfter = 5
+
+// writeQueueError answers a request that did not get a slot. A timeout means
+// the queue is saturated, a drained queue that the server is shutting down and
+// a done context that the client went away.
+func writeQueueError(w http.ResponseWriter, queue *Queue, err error) {
+	retryAfter := defaultRetryAfter
+	if d := queue.MaxWait(); d > 0 {
+		retryAfter = int(math.Ceil(d.Seconds()))
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if errors.Is(err, ErrQueueTimeout) {
+		http.Error(w, "no slot available, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, ErrDraining) {
+		http.Error(w, "server is shutting down, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "request cancelled while waiting for slot", http.StatusServiceUnavailable)
+}
@@ -1,12 +1,13 @@
 package llamacpp
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,123 +18,171 @@ func handleTools(
 	w http.ResponseWriter,
 	llama func(Request, func([]byte) bool, bool) error,
 	stream bool,
+	streamIncludeUsage bool,
 	llamacppRequestId string,
 	model string,
 	stop []string,
+	toolDecisionBias [][2]float64,
 	l *slog.Logger,
 	chatReq openai.ChatRequest,
-	toolCalls *ExpiringMap,
+	toolCalls ToolCallStore,
+	owner ToolCallOwner,
 	prepareChatPrompt func([]openai.Message) (string, error),
 ) (bool, error) {
-	if len(chatReq.Tools) == 0 || chatReq.ToolChoice == "none" {
+	choice := chatReq.ToolChoice
+	if len(chatReq.Tools) == 0 || choice.Mode == "none" {
 		return false, nil
 	}
 	// prepare tool list for prompt, return if no tools
-	lastTool, exists := getLastTool(chatReq.Messages, toolCalls)
-	tools, exists := toolsToPrompt(chatReq.Tools, []string{lastTool})
+	var available []openai.Tool
+	if choice.Mode == "function" {
+		// a forced function is the only tool to generate
+		for _, tool := range chatReq.Tools {
+			if tool.Function.Name == choice.Function {
+				available = append(available, tool)
+			}
+		}
+		if len(available) == 0 {
+			return false, fmt.Errorf("Tool not found: %s", choice.Function)
+		}
+	} else {
+		available = filterTools(chatReq.Tools, lastTools(l, chatReq.Messages, toolCalls, owner))
+	}
+	tools, exists := toolsToPrompt(available)
 	if !exists {
 		return false, nil
 	}
 	l.Debug("Found Tools")
-	if chatReq.ToolChoice != "required" {
+	if choice.Mode != "required" && choice.Mode != "function" {
 		// check if a tool is helpful for the users request, return if not
-		if !checkIfToolHelpful(llama, l, stop, prepareChatPrompt, chatReq.Messages, tools) {
+		if !checkIfToolHelpful(llama, l, stop, toolDecisionBias, prepareChatPrompt, chatReq.Messages, tools) {
 			l.Debug("Finished Tools: Do NOT use Tool")
 			return false, nil
 		}
 	}
 	l.Debug("Get Tool Call")
-	toolCall, err := generateToolCall(llama, l, stop, prepareChatPrompt, chatReq.Messages, tools)
+	parallel := chatReq.ParallelToolCalls == nil || *chatReq.ParallelToolCalls
+	// the grammar restricts the tool calls to JSON matching the tools
+	generated, usage, err := generateToolCall(
+		llama, l, stop, prepareChatPrompt, chatReq.Messages, tools,
+		toolCallGrammar(available, parallel), parallel)
 	if err != nil {
 		l.Error("Error generating tool call")
 		return false, err
 	}
-	// the tool call is generated as a string of a python function call, parsing it
-	name, arguments, err := parseFunction(toolCall)
+	calls, err := parseToolCalls(generated)
 	if err != nil {
-		l.Error("Error parsing function")
+		l.Error("Error parsing tool call", "error", err)
 		return false, err
 	}
-	var tool *openai.Tool
-	for _, t := range chatReq.Tools {
-		if t.Function.Name == name {
-			tool = &t
-			break
-		}
+	if !parallel && len(calls) > 1 {
+		calls = calls[:1]
 	}
-	if tool == nil {
-		l.Error("Error: Tool not found", "name", name)
-		return false, fmt.Errorf("Tool not found: %s", name)
+	for _, call := range calls {
+		if !hasTool(available, call.name) {
+			l.Error("Error: Tool not found", "name", call.name)
+			return false, fmt.Errorf("Tool not found: %s", call.name)
+		}
 	}
 
 	// write http response: OpenAI API compatible tool response
-	complMsg, finishReason, toolCallID := createToolChatcompletionMessage(tool.Function, arguments)
-	writeChatCompletionResponse(
-		w,
-		stream,
-		llamacppRequestId,
-		model,
-		complMsg,
-		finishReason,
-		true,
-		true,
-	)
-	// add toolCall to map
-	toolCalls.Set(toolCallID, name)
-	l.Debug("Finished Tools: Tool requested")
+	complMsg, finishReason := createToolChatcompletionMessage(calls)
+	// store toolCalls before answering, the next turn may refer to them
+	now := time.Now()
+	for _, tc := range complMsg.ToolCalls {
+		if err := toolCalls.Set(StoredToolCall{
+			Id:        tc.Id,
+			Name:      tc.Function.Name,
+			Arguments: tc.Function.Arguments,
+			Model:     model,
+			Owner:     owner,
+			Created:   now,
+		}); err != nil {
+			l.Error("Error storing tool call", "id", tc.Id, "error", err)
+		}
+	}
+	if stream {
+		if err := writeToolCallStream(
+			w, llamacppRequestId, model, complMsg, finishReason, streamIncludeUsage, usage,
+		); err != nil {
+			l.Info("Error writing tool calls", "error", err)
+		}
+		w.Write([]byte("\ndata: [DONE]"))
+	} else if err := writeChatCompletionResponse(
+		w, stream, llamacppRequestId, model, complMsg, finishReason, nil, true, false, usage,
+	); err != nil {
+		l.Info("Error writing tool calls", "error", err)
+	}
+	l.Debug("Finished Tools: Tool requested", "calls", len(calls))
 	return true, nil
 }
 
-func getLastTool(msgs []openai.Message, toolCalls *ExpiringMap) (string, bool) {
-	last := msgs[len(msgs)-1]
-	if last.Role == "tool" {
-		return toolCalls.Get(*last.ToolCallID)
-	}
-	return "", false
+// toolCall is a tool call generated by the model.
+type toolCall struct {
+	name      string
+	arguments string // compact JSON
 }
 
-func parseFunction(input string) (string, map[string]string, error) {
-	// Find the function name and parameters
-	re := regexp.MustCompile(`(\w+)\((.*)\)`)
-	matches := re.FindStringSubmatch(input)
-	if len(matches) < 3 {
-		return "", nil, fmt.Errorf("invalid input format")
+// parseToolCalls parses tool calls generated as
+// {"name": ..., "arguments": {...}} or as a list of those.
+func parseToolCalls(input string) ([]toolCall, error) {
+	type generatedCall struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
 	}
-
-	funcName := matches[1]
-	funcArguments := make(map[string]string)
-
-	// Split the parameters by commas outside brackets
-	re = regexp.MustCompile(`\w+=\[[^\[\]]*\]|\w+="[^"]*"|\w+=[^,]+`)
-	params := re.FindAllString(matches[2], -1)
-
-	for _, p := range params {
-		parts := strings.SplitN(p, "=", 2)
-		if len(parts) != 2 {
-			return "", nil, fmt.Errorf("invalid parameter format")
+	input = strings.TrimSpace(input)
+	var generated []generatedCall
+	if strings.HasPrefix(input, "[") {
+		if err := json.Unmarshal([]byte(input), &generated); err != nil {
+			return nil, fmt.Errorf("invalid tool calls: %w", err)
 		}
-
-		paramName := strings.TrimSpace(parts[0])
-		paramValue := strings.TrimSpace(parts[1])
-
-		// Remove surrounding quotes from the value if present
-		if strings.HasPrefix(paramValue, `"`) && strings.HasSuffix(paramValue, `"`) {
-			paramValue = strings.Trim(paramValue, `"`)
+	} else {
+		var call generatedCall
+		if err := json.Unmarshal([]byte(input), &call); err != nil {
+			return nil, fmt.Errorf("invalid tool call: %w", err)
 		}
-
-		funcArguments[paramName] = paramValue
+		generated = []generatedCall{call}
+	}
+	if len(generated) == 0 {
+		return nil, fmt.Errorf("no tool call generated")
 	}
+	calls := make([]toolCall, len(generated))
+	for i, call := range generated {
+		arguments := bytes.Buffer{}
+		if err := json.Compact(&arguments, call.Arguments); err != nil {
+			return nil, fmt.Errorf("invalid tool call arguments: %w", err)
+		}
+		calls[i] = toolCall{name: call.Name, arguments: arguments.String()}
+	}
+	return calls, nil
+}
 
-	return funcName, funcArguments, nil
+// hasTool reports whether tools contains a function named name.
+func hasTool(tools []openai.Tool, name string) bool {
+	for _, tool := range tools {
+		if tool.Function.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
-func toolsToPrompt(tools []openai.Tool, ignoreTools []string) (string, bool) {
-	var result []string
+// filterTools returns tools without the ones named in ignoreTools.
+func filterTools(tools []openai.Tool, ignoreTools []string) []openai.Tool {
+	var result []openai.Tool
 	for _, tool := range tools {
 		if !contains(ignoreTools, tool.Function.Name) {
-			result = append(result, toolToPrompt(tool))
+			result = append(result, tool)
 		}
 	}
+	return result
+}
+
+func toolsToPrompt(tools []openai.Tool) (string, bool) {
+	var result []string
+	for _, tool := range tools {
+		result = append(result, toolToPrompt(tool))
+	}
 	if len(result) == 0 {
 		return "", false
 	}
@@ -152,16 +201,23 @@ func contains(slice []string, str string) bool {
 func toolToPrompt(tool openai.Tool) string {
 	var parameters []string
 	var parDescs []string
-	for parameter, value := range tool.Function.Parameters.Properties {
-		parType := "str"
-		if value.Type == "integer" {
-			parType = "int"
+	props := tool.Function.Parameters.Properties
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, parameter := range keys {
+		value := props[parameter]
+		parameters = append(parameters, fmt.Sprintf("%s: %s", parameter, pythonType(value)))
+		desc := value.Description
+		if len(value.Enum) > 0 {
+			desc += " " + joinValues(value.Enum)
 		}
-		parameters = append(parameters, fmt.Sprintf("%s: %s", parameter, parType))
-		parDescs = append(
-			parDescs,
-			fmt.Sprintf("%s: %s %s", parameter, value.Description, strings.Join(value.Enum, ", ")),
-		)
+		if len(value.Default) > 0 {
+			desc += fmt.Sprintf(" (default: %s)", compactJSON(value.Default))
+		}
+		parDescs = append(parDescs, fmt.Sprintf("%s: %s", parameter, desc))
 	}
 	return fmt.Sprintf(
 		"%s(%s) # %s (%s)",
@@ -171,16 +227,71 @@ func toolToPrompt(tool openai.Tool) string {
 		strings.Join(parDescs, ", "))
 }
 
+// pythonType renders the type of a JSON Schema as a Python type hint for the
+// tool prompt.
+func pythonType(s openai.Schema) string {
+	if alternatives := append(s.AnyOf, s.OneOf...); len(alternatives) > 0 {
+		var types []string
+		for _, alt := range alternatives {
+			types = append(types, pythonType(alt))
+		}
+		return strings.Join(types, " | ")
+	}
+	if len(s.Type) == 0 {
+		switch {
+		case len(s.Properties) > 0:
+			return "dict"
+		case s.Items != nil:
+			return "list[" + pythonType(*s.Items) + "]"
+		}
+		return "Any"
+	}
+	var types []string
+	for _, t := range s.Type {
+		switch t {
+		case "string":
+			types = append(types, "str")
+		case "integer":
+			types = append(types, "int")
+		case "number":
+			types = append(types, "float")
+		case "boolean":
+			types = append(types, "bool")
+		case "null":
+			types = append(types, "None")
+		case "array":
+			if s.Items != nil {
+				types = append(types, "list["+pythonType(*s.Items)+"]")
+			} else {
+				types = append(types, "list")
+			}
+		case "object":
+			types = append(types, "dict")
+		default:
+			types = append(types, "Any")
+		}
+	}
+	return strings.Join(types, " | ")
+}
+
+// joinValues joins enum values for the tool prompt.
+func joinValues(values []interface{}) string {
+	var parts []string
+	for _, v := range values {
+		parts = append(parts, fmt.Sprint(v))
+	}
+	return strings.Join(parts, ", ")
+}
+
 func checkIfToolHelpful(
 	llama func(Request, func([]byte) bool, bool) error,
 	l *slog.Logger,
 	stop []string,
+	logitBias [][2]float64,
 	prepareChatPrompt func([]openai.Message) (string, error),
 	msgs []openai.Message,
 	tools string,
 ) bool {
-	ml := len(msgs)
-	ms := make([]openai.Message, ml+1)
 	mu, exists := getLastUserMessage(msgs)
 	if !exists {
 		return false
@@ -188,8 +299,7 @@ func checkIfToolHelpful(
 	if mu.Role != "user" {
 		return false
 	}
-	copy(ms, msgs)
-	ms[ml] = openai.Message{
+	ms := withInstruction(msgs, openai.Message{
 		Role: "user",
 		Content: openai.Content(fmt.Sprintf(
 			"Decide if it would be helpful to execute one of the "+
@@ -201,14 +311,14 @@ func checkIfToolHelpful(
 			tools,
 			mu.Content,
 		)),
-	}
-	l.Debug("Helpful desicion", "helpfulMessage", ms[ml-1])
+	})
+	l.Debug("Helpful desicion", "helpfulMessage", mu)
 	helpful := false
 	yield := func(b []byte) bool {
 		var r LlamaResponse
 		err := json.Unmarshal(b, &r)
 		if err != nil {
-			l.Error("Error unmarshaling data", err)
+			l.Error("Error unmarshaling data", "error", err)
 			return false
 		}
 		l.Debug("Helful response", "response", r)
@@ -217,7 +327,7 @@ func checkIfToolHelpful(
 	}
 	prompt, err := prepareChatPrompt(ms)
 	if err != nil {
-		l.Debug("Error preparing function helpfulness prompt", err)
+		l.Debug("Error preparing function helpfulness prompt", "error", err)
 		return false
 	}
 	var temperature float32
@@ -229,7 +339,7 @@ func checkIfToolHelpful(
 		Temperature: &temperature,
 		CachePrompt: true,
 		Stop:        stop,
-		LogitBias:   [][2]float64{{382, -0.3}},
+		LogitBias:   logitBias,
 	}
 	if err := llama(req, yield, false); err != nil {
 		l.Error("Error calling Backend")
@@ -238,6 +348,16 @@ func checkIfToolHelpful(
 	return helpful
 }
 
+// withInstruction returns msgs followed by the user message instruction. The
+// instructions quote the user's question, so a trailing user message is
+// replaced, as templates like Mistral's reject consecutive user messages.
+func withInstruction(msgs []openai.Message, instruction openai.Message) []openai.Message {
+	if len(msgs) > 0 && msgs[len(msgs)-1].Role == "user" {
+		msgs = msgs[:len(msgs)-1]
+	}
+	return append(append([]openai.Message{}, msgs...), instruction)
+}
+
 func getLastUserMessage(messages []openai.Message) (openai.Message, bool) {
 	var mu *openai.Message
 	for _, msg := range messages {
@@ -258,30 +378,34 @@ func generateToolCall(
 	prepareChatPrompt func([]openai.Message) (string, error),
 	msgs []openai.Message,
 	tools string,
-) (string, error) {
+	grammar string,
+	parallel bool,
+) (string, *openai.ChatResponseUsage, error) {
 	var result string
-	ml := len(msgs)
-	ms := make([]openai.Message, ml+1)
+	var usage *openai.ChatResponseUsage
 	mu, exsist := getLastUserMessage(msgs)
 	if !exsist {
-		return "", fmt.Errorf("no user message found")
+		return "", nil, fmt.Errorf("no user message found")
 	}
-	copy(ms, msgs)
-	ms[ml] = openai.Message{
-		Role: "user",
-		Content: openai.Content(fmt.Sprintf(
-			"Use one of the following functions to answer the user question. "+
-				"<functions>\n%s</functions> <user-question>%s</user-question> "+
-				"Generate the function call. example: "+
-				"CALL: height(building=\"Empire State Building\")",
-			tools,
-			mu.Content,
-		)),
+	instruction := "Use one of the following functions to answer the user question. " +
+		"<functions>\n%s</functions> <user-question>%s</user-question> " +
+		"Generate the function call as JSON. example: " +
+		"{\"name\": \"height\", \"arguments\": {\"building\": \"Empire State Building\"}}"
+	if parallel {
+		instruction = "Use the following functions to answer the user question. " +
+			"<functions>\n%s</functions> <user-question>%s</user-question> " +
+			"Generate a JSON list of all function calls needed, they are executed in parallel. example: " +
+			"[{\"name\": \"height\", \"arguments\": {\"building\": \"Empire State Building\"}}, " +
+			"{\"name\": \"height\", \"arguments\": {\"building\": \"Eiffel Tower\"}}]"
 	}
+	ms := withInstruction(msgs, openai.Message{
+		Role:    "user",
+		Content: openai.Content(fmt.Sprintf(instruction, tools, mu.Content)),
+	})
 	prompt, err := prepareChatPrompt(ms)
 	if err != nil {
-		l.Debug("Error preparing function creation prompt", err)
-		return "", err
+		l.Debug("Error preparing function creation prompt", "error", err)
+		return "", nil, err
 	}
 	var temperature float32
 	temperature = 0.01
@@ -289,57 +413,72 @@ func generateToolCall(
 		Request{
 			Prompt:      prompt,
 			Stream:      false,
-			NPredict:    90,
+			NPredict:    500,
 			Temperature: &temperature,
 			CachePrompt: true,
 			Stop:        stop,
+			Grammar:     &grammar,
 		},
 		func(b []byte) bool {
 			var r LlamaResponse
 			err := json.Unmarshal(b, &r)
 			if err != nil {
-				l.Error("Error unmarshaling data", err)
+				l.Error("Error unmarshaling data", "error", err)
 				return false
 			}
-			content, _ := strings.CutPrefix(strings.Trim(r.Content, " "), "CALL: ")
-			result = strings.ReplaceAll(content, "\\_", "_")
-			l.Debug("FUNCTION", "content", content)
+			result = r.Content
+			usage = usageFromLlamaResponse(r)
+			l.Debug("FUNCTION", "content", r.Content)
 			return true
 		},
 		false); err != nil {
 		l.Error("Error calling Backend")
-		return "", err
+		return "", nil, err
 	}
-	return result, nil
+	return result, usage, nil
 }
 
-func createToolChatcompletionMessage(
-	function openai.Function,
-	toolArguments map[string]string,
-) (openai.ChatCompletionMessage, *string, string) {
-	var argStrings []string
-	for k, v := range toolArguments {
-		if p, ok := function.Parameters.Properties[k]; ok {
-			if p.Type == "string" {
-				argStrings = append(argStrings, fmt.Sprintf("\"%s\":\"%s\"", k, v))
-			} else {
-				argStrings = append(argStrings, fmt.Sprintf("\"%s\":%s", k, v))
+// toolCallIdChars are the characters of tool call ids.
+const toolCallIdChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// newToolCallId returns a random id of nine alphanumeric characters, the ids
+// Mistral's templates accept. Ids must not be guessable, as they refer to
+// stored tool calls.
+func newToolCallId() string {
+	id := make([]byte, 0, 9)
+	b := make([]byte, 16)
+	for len(id) < cap(id) {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		for _, c := range b {
+			// reject bytes beyond the largest multiple of the alphabet's
+			// length, so all characters are equally likely
+			if int(c) < 256-256%len(toolCallIdChars) && len(id) < cap(id) {
+				id = append(id, toolCallIdChars[int(c)%len(toolCallIdChars)])
 			}
 		}
 	}
-	toolCallId := strconv.FormatInt(time.Now().UnixNano(), 16)
-	finish_reason := "tool_call"
-	return openai.ChatCompletionMessage{
-		Role: "assistant",
-		ToolCalls: []openai.ToolCall{
-			{
-				Id:   toolCallId,
-				Type: "function",
-				Function: openai.ChatCompletionFunction{
-					Name:      function.Name,
-					Arguments: fmt.Sprintf("{%s}", strings.Join(argStrings, ",")),
-				},
+	return string(id)
+}
+
+func createToolChatcompletionMessage(
+	calls []toolCall,
+) (openai.ChatCompletionMessage, *string) {
+	toolCalls := make([]openai.ToolCall, len(calls))
+	for i, call := range calls {
+		toolCalls[i] = openai.ToolCall{
+			Id:   newToolCallId(),
+			Type: "function",
+			Function: openai.ChatCompletionFunction{
+				Name:      call.name,
+				Arguments: call.arguments,
 			},
-		},
-	}, &finish_reason, toolCallId
+		}
+	}
+	finish_reason := "tool_calls"
+	return openai.ChatCompletionMessage{
+		Role:      "assistant",
+		ToolCalls: toolCalls,
+	}, &finish_reason
 }
@@ -0,0 +1,190 @@
+package llamacpp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+)
+
+// HealthCheck configures the background health checking of a [Queue]'s
+// endpoints. Slots of an unhealthy endpoint are not handed out.
+type HealthCheck struct {
+	// Interval between two checks of an endpoint, defaults to 5s.
+	Interval time.Duration
+	// Timeout of a single check, defaults to Interval.
+	Timeout time.Duration
+	// Path requested on the endpoint's host, defaults to "/health".
+	Path string
+	// Failures is the number of consecutive failed checks after which an
+	// endpoint is taken out of rotation, defaults to 1.
+	Failures int
+	// Successes is the number of consecutive successful checks after which an
+	// unhealthy endpoint is put back into rotation, defaults to 2.
+	Successes int
+}
+
+// defaultHealthCheckInterval is used if [HealthCheck.Interval] is not set.
+const defaultHealthCheckInterval = 5 * time.Second
+
+// WithHealthCheck polls every endpoint of the queue in the background. Use
+// [Queue.Close] to stop it.
+func WithHealthCheck(hc HealthCheck) QueueOption {
+	return func(q *Queue) {
+		if hc.Interval <= 0 {
+			hc.Interval = defaultHealthCheckInterval
+		}
+		if hc.Timeout <= 0 {
+			hc.Timeout = hc.Interval
+		}
+		if hc.Path == "" {
+			hc.Path = "/health"
+		}
+		if hc.Failures < 1 {
+			hc.Failures = 1
+		}
+		if hc.Successes < 1 {
+			hc.Successes = 2
+		}
+		q.healthCheck = &hc
+	}
+}
+
+// endpointHealth tracks the consecutive check results of an endpoint.
+type endpointHealth struct {
+	healthy   bool
+	failures  int
+	successes int
+}
+
+// ReportFailure takes the endpoint of s out of rotation right away, e.g.
+// after a failed backend call. The endpoint returns once the health check
+// succeeds again, so this has no effect without [WithHealthCheck].
+func (q *Queue) ReportFailure(s Slot) {
+	if q.healthCheck == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	ep, ok := q.endpoints[s.endpointSlot.endpoint]
+	if !ok || !ep.health.healthy {
+		return
+	}
+	slog.Warn("Endpoint suspect after failed request", "endpoint", s.endpointSlot.endpoint)
+	ep.health.healthy = false
+	ep.health.successes = 0
+}
+
+// Healthy reports whether endpoint is in rotation.
+func (q *Queue) Healthy(endpoint string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	ep, ok := q.endpoints[endpoint]
+	return ok && ep.health.healthy
+}
+
+// Close stops background work of the queue such as health checking and
+// props discovery.
+func (q *Queue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+}
+
+// recordHealth updates the health of endpoint with the result of a check and
+// hands out slots of endpoints that became healthy.
+func (q *Queue) recordHealth(endpoint string, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	ep, exists := q.endpoints[endpoint]
+	if !exists {
+		return
+	}
+	h := &ep.health
+	if ok {
+		h.failures = 0
+		h.successes++
+		if !h.healthy && h.successes >= q.healthCheck.Successes {
+			slog.Info("Endpoint healthy", "endpoint", endpoint)
+			h.healthy = true
+			q.dispatch()
+		}
+		return
+	}
+	h.successes = 0
+	h.failures++
+	if h.healthy && h.failures >= q.healthCheck.Failures {
+		slog.Warn("Endpoint unhealthy", "endpoint", endpoint)
+		h.healthy = false
+	}
+}
+
+func (q *Queue) runHealthCheck() {
+	client := &http.Client{Timeout: q.healthCheck.Timeout}
+	ticker := time.NewTicker(q.healthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		q.mutex.Lock()
+		endpoints := make([]string, 0, len(q.endpoints))
+		for ep := range q.endpoints {
+			endpoints = append(endpoints, ep)
+		}
+		q.mutex.Unlock()
+
+		var wg sync.WaitGroup
+		for _, ep := range endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := checkHealth(client, ep, q.healthCheck.Path)
+				if err != nil {
+					slog.Debug("Health check failed", "endpoint", ep, "error", err)
+				}
+				q.recordHealth(ep, err == nil)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkHealth(client *http.Client, endpoint string, path string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(u.ResolveReference(ref).String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// isBackendFailure reports whether err returned by a handleFunc means the
+// backend failed, as opposed to the client going away or llama.cpp rejecting
+// the request.
+func isBackendFailure(ctx context.Context, err error) bool {
+	var status *handler.StatusError
+	if errors.As(err, &status) && status.StatusCode < 500 {
+		return false
+	}
+	return ctx.Err() == nil && !errors.Is(err, handler.ErrWriteResponse)
+}
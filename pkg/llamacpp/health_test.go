@@ -0,0 +1,134 @@
+package llamacpp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	endpoint := server.URL + "/completion"
+	q := NewQueue(
+		[]handler.Endpoint{{Endpoint: endpoint, Parallel: 1}},
+		WithMaxWait(20*time.Millisecond),
+		WithHealthCheck(HealthCheck{Interval: 5 * time.Millisecond, Successes: 2}),
+	)
+	defer q.Close()
+
+	waitFor := func(expected bool) {
+		deadline := time.Now().Add(time.Second)
+		for q.Healthy(endpoint) != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected healthy=%v", expected)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitFor(false)
+	if _, err := q.RequestSlotContext(context.Background(), 1, -1); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("expected ErrQueueTimeout for unhealthy endpoint; got %v", err)
+	}
+
+	healthy.Store(true)
+	waitFor(true)
+	slot, err := q.RequestSlotContext(context.Background(), 1, -1)
+	if err != nil {
+		t.Fatalf("expected slot; got %v", err)
+	}
+
+	// a failed request takes the endpoint out of rotation until checks succeed
+	healthy.Store(false)
+	q.ReportFailure(slot)
+	if q.Healthy(endpoint) {
+		t.Errorf("expected endpoint to be suspect after failure")
+	}
+	q.ReleaseSlot(slot)
+	healthy.Store(true)
+	waitFor(true)
+}
+
+func TestHealthCheckDefaults(t *testing.T) {
+	q := NewQueue(
+		[]handler.Endpoint{{Endpoint: "http://localhost:8080", Parallel: 1}},
+		WithHealthCheck(HealthCheck{}),
+	)
+	defer q.Close()
+	hc := q.healthCheck
+	if hc.Interval != defaultHealthCheckInterval || hc.Timeout != defaultHealthCheckInterval {
+		t.Errorf("expected interval and timeout %v; got %v and %v",
+			defaultHealthCheckInterval, hc.Interval, hc.Timeout)
+	}
+	if hc.Path != "/health" || hc.Failures != 1 || hc.Successes != 2 {
+		t.Errorf("unexpected defaults %+v", *hc)
+	}
+}
+
+func TestBackendStatusErrors(t *testing.T) {
+	var status atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte(`{"error":{"code":400,"message":"context exceeded","type":"invalid_request_error"}}`))
+	}))
+	defer server.Close()
+
+	endpoint := server.URL + "/completion"
+	q := NewQueue(
+		[]handler.Endpoint{{Endpoint: endpoint, Parallel: 1}},
+		WithHealthCheck(HealthCheck{Interval: time.Hour}),
+	)
+	defer q.Close()
+	chat := newModelHandler(
+		slog.Default(),
+		false,
+		Model{ChatTemplate: `{{ range . }}{{ .Content }}{{ end }}`, Queue: q},
+		handleLlamacpp,
+	)
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		chat.ServeHTTP(w, httptest.NewRequest("POST", "/",
+			strings.NewReader(`{"model": "m", "messages": [{"role": "user", "content": "Hi"}]}`)))
+		return w
+	}
+
+	// llama.cpp rejecting the request is not a backend failure
+	status.Store(http.StatusBadRequest)
+	if w := request(); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "context exceeded") {
+		t.Errorf("expected the client error of llama.cpp; got %d: %s", w.Code, w.Body)
+	}
+	if !q.Healthy(endpoint) {
+		t.Errorf("expected endpoint to stay healthy after a client error")
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	w := request()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After; got %d: %s", w.Code, w.Body)
+	}
+	if q.Healthy(endpoint) {
+		t.Errorf("expected endpoint to be suspect after 503")
+	}
+}
@@ -0,0 +1,111 @@
+package llamacpp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+// ImageData is an image of a llama.cpp request, referenced in the prompt by
+// the placeholder [img-Id].
+type ImageData struct {
+	Data string `json:"data"` // base64
+	Id   int    `json:"id"`
+}
+
+// ImageLimits limit the images of a chat request.
+type ImageLimits struct {
+	// MaxImages per request, 0 rejects images.
+	MaxImages int
+	// MaxBytes is the maximum decoded size of an image.
+	MaxBytes int
+}
+
+// DefaultImageLimits are used without [WithImageLimits].
+var DefaultImageLimits = ImageLimits{MaxImages: 4, MaxBytes: 10 << 20}
+
+// WithImageLimits sets the limits for images of chat requests, which are
+// passed to llama.cpp as image_data for multimodal (LLaVA style) models.
+func WithImageLimits(limits ImageLimits) ChatOption {
+	return func(c *chatConfig) {
+		c.images = &limits
+	}
+}
+
+// extractImages replaces the image parts of msgs with [img-N] placeholders
+// in their content and returns the images as llama.cpp image_data. Only
+// base64 data URLs are accepted, the middleware does not fetch images.
+func extractImages(msgs []openai.Message, limits ImageLimits) ([]openai.Message, []ImageData, error) {
+	var images []ImageData
+	var extracted []openai.Message
+	for i, m := range msgs {
+		if len(m.Parts) == 0 {
+			continue
+		}
+		if extracted == nil {
+			extracted = append([]openai.Message{}, msgs...)
+		}
+		var content []string
+		for _, p := range m.Parts {
+			switch {
+			case p.Type == "text":
+				content = append(content, p.Text)
+			case p.Type == "image_url" && p.ImageURL != nil:
+				if len(images) == limits.MaxImages {
+					return nil, nil, &paramError{
+						"messages",
+						fmt.Sprintf("At most %d images are supported per request.", limits.MaxImages),
+					}
+				}
+				data, err := imageFromDataURL(p.ImageURL.URL, limits.MaxBytes)
+				if err != nil {
+					return nil, nil, err
+				}
+				id := len(images) + 1
+				images = append(images, ImageData{Data: data, Id: id})
+				content = append(content, fmt.Sprintf("[img-%d]", id))
+			}
+		}
+		extracted[i].Content = openai.Content(strings.Join(content, "\n"))
+		extracted[i].Parts = nil
+	}
+	if extracted == nil {
+		return msgs, nil, nil
+	}
+	return extracted, images, nil
+}
+
+// imageFromDataURL returns the base64 data of the data URL of an image of at
+// most maxBytes bytes.
+func imageFromDataURL(url string, maxBytes int) (string, error) {
+	header, data, ok := strings.Cut(url, ",")
+	if !ok || !strings.HasPrefix(header, "data:image/") || !strings.HasSuffix(header, ";base64") {
+		return "", &paramError{"messages", "Images must be given as base64 data URLs."}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", &paramError{"messages", "Invalid base64 data of an image."}
+	}
+	if len(decoded) > maxBytes {
+		return "", &paramError{
+			"messages",
+			fmt.Sprintf("Images may be at most %d bytes; got %d bytes.", maxBytes, len(decoded)),
+		}
+	}
+	return data, nil
+}
+
+// countImages returns the number of images of msgs.
+func countImages(msgs []openai.Message) int {
+	n := 0
+	for _, m := range msgs {
+		for _, p := range m.Parts {
+			if p.Type == "image_url" && p.ImageURL != nil {
+				n++
+			}
+		}
+	}
+	return n
+}
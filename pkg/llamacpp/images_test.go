@@ -0,0 +1,66 @@
+package llamacpp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+func TestExtractImages(t *testing.T) {
+	body := `{"messages": [
+		{"role": "system", "content": "Describe images."},
+		{"role": "user", "content": [
+			{"type": "text", "text": "Compare"},
+			{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0K"}},
+			{"type": "text", "text": "with"},
+			{"type": "image_url", "image_url": {"url": "data:image/jpeg;base64,/9j/4AAQ"}}
+		]}
+	]}`
+	var chatReq openai.ChatRequest
+	if err := json.Unmarshal([]byte(body), &chatReq); err != nil {
+		t.Fatalf("decoding request: %v", err)
+	}
+	if chatReq.Messages[1].Content != "Compare\nwith" {
+		t.Errorf("expected text content; got %q", chatReq.Messages[1].Content)
+	}
+
+	msgs, images, err := extractImages(chatReq.Messages, DefaultImageLimits)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "Compare\n[img-1]\nwith\n[img-2]"; string(msgs[1].Content) != expected {
+		t.Errorf("expected %q; got %q", expected, msgs[1].Content)
+	}
+	if len(images) != 2 || images[0] != (ImageData{Data: "iVBORw0K", Id: 1}) || images[1].Id != 2 {
+		t.Errorf("unexpected image data %+v", images)
+	}
+	if chatReq.Messages[1].Parts == nil {
+		t.Errorf("expected messages of the request to be unchanged")
+	}
+
+	u := NewLlamacppUsageUpdater().UsageFromInput(context.Background(), []byte(body))
+	if u.Images != 2 {
+		t.Errorf("expected usage of 2 images; got %d", u.Images)
+	}
+
+	for name, limits := range map[string]ImageLimits{
+		"MaxImages": {MaxImages: 1, MaxBytes: 1024},
+		"MaxBytes":  {MaxImages: 2, MaxBytes: 4},
+	} {
+		_, _, err := extractImages(chatReq.Messages, limits)
+		var invalid *paramError
+		if !errors.As(err, &invalid) {
+			t.Errorf("expected invalid images for %s; got %v", name, err)
+		}
+	}
+
+	chatReq.Messages[1].Parts[1].ImageURL.URL = "https://example.com/image.png"
+	_, _, err = extractImages(chatReq.Messages, DefaultImageLimits)
+	if err == nil || !strings.Contains(err.Error(), "data URL") {
+		t.Errorf("expected an error for an image URL; got %v", err)
+	}
+}
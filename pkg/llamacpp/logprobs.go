@@ -0,0 +1,114 @@
+package llamacpp
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+// minLogprob is reported for tokens with a probability of 0, as OpenAI does.
+const minLogprob = -9999.0
+
+// llamaTokenProbs is an entry of llama.cpp's completion_probabilities. Newer
+// servers report log probabilities (token, logprob, top_logprobs), older ones
+// probabilities (content, probs).
+type llamaTokenProbs struct {
+	Token       string            `json:"token"`
+	Logprob     *float64          `json:"logprob"`
+	Bytes       []int             `json:"bytes"`
+	TopLogprobs []llamaTopLogprob `json:"top_logprobs"`
+	Content     string            `json:"content"`
+	Probs       []llamaProb       `json:"probs"`
+}
+
+type llamaTopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type llamaProb struct {
+	TokStr string  `json:"tok_str"`
+	Prob   float64 `json:"prob"`
+}
+
+// logprobsFromLlamaLine converts the completion_probabilities of a llama.cpp
+// response line into OpenAI logprobs with at most top top_logprobs per token.
+// It returns nil for lines without probabilities.
+func logprobsFromLlamaLine(line []byte, top int) (*openai.Logprobs, error) {
+	data := bytes.TrimPrefix(line, []byte("data: "))
+	if len(data) < 2 {
+		return nil, nil
+	}
+	var r struct {
+		CompletionProbabilities []llamaTokenProbs `json:"completion_probabilities"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if len(r.CompletionProbabilities) == 0 {
+		return nil, nil
+	}
+	logprobs := &openai.Logprobs{Content: []openai.TokenLogprob{}}
+	for _, p := range r.CompletionProbabilities {
+		logprobs.Content = append(logprobs.Content, tokenLogprob(p, top))
+	}
+	return logprobs, nil
+}
+
+func tokenLogprob(p llamaTokenProbs, top int) openai.TokenLogprob {
+	tl := openai.TokenLogprob{TopLogprobs: []openai.TopLogprob{}}
+	if p.Logprob != nil {
+		tl.Token, tl.Logprob, tl.Bytes = p.Token, *p.Logprob, tokenBytes(p.Token, p.Bytes)
+		for _, c := range p.TopLogprobs {
+			if len(tl.TopLogprobs) == top {
+				break
+			}
+			tl.TopLogprobs = append(tl.TopLogprobs, openai.TopLogprob{
+				Token: c.Token, Logprob: c.Logprob, Bytes: tokenBytes(c.Token, c.Bytes),
+			})
+		}
+		return tl
+	}
+
+	// the probability of the sampled token is only known if it is among the
+	// most likely ones
+	tl.Token, tl.Logprob, tl.Bytes = p.Content, minLogprob, tokenBytes(p.Content, nil)
+	for _, c := range p.Probs {
+		if c.TokStr == p.Content {
+			tl.Logprob = logprob(c.Prob)
+			break
+		}
+	}
+	for _, c := range p.Probs {
+		if len(tl.TopLogprobs) == top {
+			break
+		}
+		tl.TopLogprobs = append(tl.TopLogprobs, openai.TopLogprob{
+			Token: c.TokStr, Logprob: logprob(c.Prob), Bytes: tokenBytes(c.TokStr, nil),
+		})
+	}
+	return tl
+}
+
+func logprob(p float64) float64 {
+	if p <= 0 {
+		return minLogprob
+	}
+	return math.Log(p)
+}
+
+// tokenBytes returns the UTF-8 bytes of token, unless llama.cpp reported
+// them, as tokens of multi-byte characters are not valid UTF-8 by themselves.
+func tokenBytes(token string, reported []int) []int {
+	if reported != nil {
+		return reported
+	}
+	b := make([]int, len(token))
+	for i := 0; i < len(token); i++ {
+		b[i] = int(token[i])
+	}
+	return b
+}
@@ -0,0 +1,56 @@
+package llamacpp
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestLogprobsFromLlamaLine(t *testing.T) {
+	for name, line := range map[string]string{
+		"Logprobs": `data: {"content":"Hi","completion_probabilities":[{"id":1,"token":"Hi","bytes":[72,105],` +
+			`"logprob":-0.1,"top_logprobs":[{"id":1,"token":"Hi","bytes":[72,105],"logprob":-0.1},` +
+			`{"id":2,"token":"Hey","bytes":[72,101,121],"logprob":-2.5}]}]}`,
+		"Probs": `data: {"content":"Hi","completion_probabilities":[{"content":"Hi",` +
+			`"probs":[{"tok_str":"Hi","prob":0.904837},{"tok_str":"Hey","prob":0.082085}]}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			logprobs, err := logprobsFromLlamaLine([]byte(line), 1)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if logprobs == nil || len(logprobs.Content) != 1 {
+				t.Fatalf("expected logprobs of one token; got %+v", logprobs)
+			}
+			token := logprobs.Content[0]
+			if token.Token != "Hi" || math.Abs(token.Logprob+0.1) > 1e-5 {
+				t.Errorf("expected Hi with logprob -0.1; got %s with %f", token.Token, token.Logprob)
+			}
+			if len(token.Bytes) != 2 || token.Bytes[0] != 72 {
+				t.Errorf("expected bytes [72 105]; got %v", token.Bytes)
+			}
+			if len(token.TopLogprobs) != 1 || token.TopLogprobs[0].Token != "Hi" {
+				t.Errorf("expected one top logprob for Hi; got %+v", token.TopLogprobs)
+			}
+		})
+	}
+
+	logprobs, err := logprobsFromLlamaLine([]byte(`data: {"content":"Hi"}`), 0)
+	if err != nil || logprobs != nil {
+		t.Errorf("expected no logprobs; got %+v, %v", logprobs, err)
+	}
+
+	// top_logprobs is an empty list, not null, without top_logprobs
+	logprobs, err = logprobsFromLlamaLine([]byte(
+		`{"completion_probabilities":[{"token":"Hi","logprob":0,"top_logprobs":[{"token":"Hi","logprob":0}]}]}`), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := json.Marshal(logprobs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := `{"content":[{"token":"Hi","logprob":0,"bytes":[72,105],"top_logprobs":[]}]}`; string(data) != expected {
+		t.Errorf("expected %s; got %s", expected, data)
+	}
+}
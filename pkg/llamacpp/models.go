@@ -0,0 +1,309 @@
+package llamacpp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/jinja"
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+// ErrModelExists is returned when registering a model name or alias twice.
+var ErrModelExists = errors.New("model already registered")
+
+// Model configures a model served by the llama.cpp chat handler.
+type Model struct {
+	// Name is matched against the model field of chat requests.
+	Name string
+	// Aliases are additional names the model is requested by.
+	Aliases []string
+	// OwnedBy and Created are reported in model listings. Created is a Unix
+	// timestamp and defaults to the time the model is registered.
+	OwnedBy string
+	Created int64
+	// Queue of the llama.cpp servers serving the model.
+	Queue *Queue
+	// ChatTemplate is a Go text/template rendering []openai.Message into the
+	// prompt. Templates can encode values as JSON with the json function.
+	ChatTemplate string
+	// Template names a built-in [ChatTemplatePreset], used if ChatTemplate is
+	// empty. Its stop sequences are used if Stop is empty.
+	Template string
+	// JinjaTemplate is a Jinja chat template as models ship it in GGUF
+	// metadata or tokenizer_config.json, used instead of ChatTemplate.
+	JinjaTemplate string
+	// BOSToken and EOSToken are bos_token and eos_token of JinjaTemplate.
+	// BOSToken is best left empty, llama.cpp adds the BOS token itself.
+	BOSToken string
+	EOSToken string
+	// Stop sequences of the model, merged with the stop sequences of requests.
+	Stop []string
+	// LogitBias biases token ids of the model's vocabulary in every request,
+	// e.g. to suppress tokens the model tends to misuse. Biases of requests
+	// for the same tokens take precedence.
+	LogitBias [][2]float64
+	// ToolDecisionLogitBias biases the one token answer deciding whether a
+	// tool is helpful for a request, e.g. {{382, -0.3}} to make a model less
+	// eager to answer HELPFUL.
+	ToolDecisionLogitBias [][2]float64
+	// NoParallelToolCalls limits generated tool calls to one per message, for
+	// templates rejecting several, like Llama 3.1's.
+	NoParallelToolCalls bool
+	Defaults            ChatDefaults
+}
+
+// ChatDefaults are used for parameters a chat request does not set.
+type ChatDefaults struct {
+	MaxTokens   int
+	Temperature *float32
+	TopP        *float32
+}
+
+// chatModel is a model prepared for serving chat requests.
+type chatModel struct {
+	name              string
+	queue             *Queue
+	stop              []string
+	logitBias         [][2]float64
+	toolDecisionBias  [][2]float64
+	noParallelCalls   bool
+	defaults          ChatDefaults
+	prepareChatPrompt func([]openai.Message) (string, error)
+}
+
+func newChatModel(m Model) (*chatModel, error) {
+	if m.ChatTemplate == "" && m.Template != "" {
+		preset, err := ChatTemplateByName(m.Template)
+		if err != nil {
+			return nil, err
+		}
+		m.ChatTemplate = preset.Template
+		if len(m.Stop) == 0 {
+			m.Stop = preset.Stop
+		}
+	}
+	prepareChatPrompt, err := chatPromptFunc(m)
+	if err != nil {
+		return nil, err
+	}
+	return &chatModel{
+		name:              m.Name,
+		queue:             m.Queue,
+		stop:              m.Stop,
+		logitBias:         m.LogitBias,
+		toolDecisionBias:  m.ToolDecisionLogitBias,
+		noParallelCalls:   m.NoParallelToolCalls,
+		defaults:          m.Defaults,
+		prepareChatPrompt: prepareChatPrompt,
+	}, nil
+}
+
+// chatPromptFunc returns the function rendering prompts with the Jinja or Go
+// template of m. Without a template, the chat template discovered from
+// m.Queue's endpoints is used, if the queue discovers props.
+func chatPromptFunc(m Model) (func([]openai.Message) (string, error), error) {
+	if m.JinjaTemplate != "" {
+		if m.ChatTemplate != "" {
+			return nil, errors.New("both ChatTemplate and JinjaTemplate set")
+		}
+		tmpl, err := jinja.Parse(m.JinjaTemplate)
+		if err != nil {
+			return nil, err
+		}
+		return func(msgs []openai.Message) (string, error) {
+			return executeJinja(tmpl, msgs, m.BOSToken, m.EOSToken)
+		}, nil
+	}
+	if m.ChatTemplate == "" && m.Queue != nil && m.Queue.propsTimeout > 0 {
+		return discoveredChatPromptFunc(m.Queue), nil
+	}
+	tmpl, err := template.New("chat").Funcs(chatTemplateFuncs).Parse(m.ChatTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return func(msgs []openai.Message) (string, error) {
+		buf := bytes.Buffer{}
+		if err := tmpl.Execute(&buf, msgs); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}, nil
+}
+
+// errTemplateNotDiscovered is returned by the prompt function of a model with
+// a discovered template while no endpoint has reported it yet.
+var errTemplateNotDiscovered = errors.New("no chat template discovered yet")
+
+// discoveredChatPromptFunc renders prompts with the chat template discovered
+// from the endpoints of queue. The BOS token is left to llama.cpp.
+func discoveredChatPromptFunc(queue *Queue) func([]openai.Message) (string, error) {
+	var mutex sync.Mutex
+	var source string
+	var tmpl *jinja.Template
+	return func(msgs []openai.Message) (string, error) {
+		props, ok := queue.ModelProps()
+		if !ok || props.ChatTemplate == "" {
+			return "", errTemplateNotDiscovered
+		}
+		mutex.Lock()
+		if props.ChatTemplate != source {
+			parsed, err := jinja.Parse(props.ChatTemplate)
+			if err != nil {
+				mutex.Unlock()
+				return "", fmt.Errorf("parsing discovered chat template: %w", err)
+			}
+			source, tmpl = props.ChatTemplate, parsed
+		}
+		t := tmpl
+		mutex.Unlock()
+		return executeJinja(t, msgs, "", props.EOSToken)
+	}
+}
+
+func executeJinja(tmpl *jinja.Template, msgs []openai.Message, bos, eos string) (string, error) {
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, map[string]interface{}{
+		"messages":              jinjaMessages(msgs),
+		"add_generation_prompt": true,
+		"bos_token":             bos,
+		"eos_token":             eos,
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// applyDefaults sets parameters chatReq leaves open to the model's defaults
+// and turns off parallel tool calls if the model does not support them.
+func (cm *chatModel) applyDefaults(chatReq *openai.ChatRequest) {
+	if cm.noParallelCalls {
+		parallel := false
+		chatReq.ParallelToolCalls = &parallel
+	}
+	if chatReq.MaxTokens == 0 {
+		chatReq.MaxTokens = chatReq.MaxCompletionTokens
+	}
+	if chatReq.MaxTokens == 0 {
+		chatReq.MaxTokens = cm.defaults.MaxTokens
+	}
+	if chatReq.Temperature == nil {
+		chatReq.Temperature = cm.defaults.Temperature
+	}
+	if chatReq.TopP == nil {
+		chatReq.TopP = cm.defaults.TopP
+	}
+}
+
+// ModelRegistry maps model names and aliases to their configuration.
+type ModelRegistry struct {
+	mutex  sync.RWMutex
+	models []*registeredModel
+	names  map[string]*registeredModel
+}
+
+type registeredModel struct {
+	model Model
+	chat  *chatModel
+}
+
+func NewModelRegistry() *ModelRegistry {
+	return &ModelRegistry{
+		names: make(map[string]*registeredModel),
+	}
+}
+
+// Register adds m to the registry. Its chat template is parsed right away.
+// Models need a name and a queue.
+func (r *ModelRegistry) Register(m Model) error {
+	if m.Name == "" {
+		return errors.New("model without name")
+	}
+	if m.Queue == nil {
+		return fmt.Errorf("model %s without queue", m.Name)
+	}
+	cm, err := newChatModel(m)
+	if err != nil {
+		return fmt.Errorf("parsing template of model %s: %w", m.Name, err)
+	}
+	if m.Created == 0 {
+		m.Created = time.Now().Unix()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := append([]string{m.Name}, m.Aliases...)
+	for _, name := range names {
+		if _, exists := r.names[name]; exists {
+			return fmt.Errorf("%w: %s", ErrModelExists, name)
+		}
+	}
+	rm := &registeredModel{model: m, chat: cm}
+	r.models = append(r.models, rm)
+	for _, name := range names {
+		r.names[name] = rm
+	}
+	return nil
+}
+
+// Lookup returns the model registered under name or alias.
+func (r *ModelRegistry) Lookup(name string) (Model, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	rm, ok := r.names[name]
+	if !ok {
+		return Model{}, false
+	}
+	return rm.model, true
+}
+
+// Models returns all registered models in registration order.
+func (r *ModelRegistry) Models() []Model {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	models := make([]Model, len(r.models))
+	for i, rm := range r.models {
+		models[i] = rm.model
+	}
+	return models
+}
+
+// OpenAIModels lists the registered models and their aliases for
+// [openai.NewModelsHandler]. Aliases have the model's name as root, so
+// sessions allowing a model list its aliases, too.
+func (r *ModelRegistry) OpenAIModels() []openai.Model {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var models []openai.Model
+	for _, rm := range r.models {
+		ownedBy := rm.model.OwnedBy
+		if ownedBy == "" {
+			ownedBy = "system"
+		}
+		for _, name := range append([]string{rm.model.Name}, rm.model.Aliases...) {
+			m := openai.Model{
+				Id:      name,
+				Object:  "model",
+				Created: rm.model.Created,
+				OwnedBy: ownedBy,
+			}
+			if name != rm.model.Name {
+				m.Root = rm.model.Name
+			}
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+func (r *ModelRegistry) chatModel(name string) (*chatModel, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	rm, ok := r.names[name]
+	if !ok {
+		return nil, false
+	}
+	return rm.chat, true
+}
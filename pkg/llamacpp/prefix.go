@@ -0,0 +1,59 @@
+package llamacpp
+
+import (
+	"context"
+	"hash/fnv"
+)
+
+// defaultPrefixBlock is the block size in bytes of prompt prefix hashes.
+const defaultPrefixBlock = 256
+
+// WithPrefixAffinity makes the queue prefer the slot whose last prompt shares
+// the longest prefix with the prompt of a request, so llama.cpp can reuse its
+// prompt cache across users. Prompts are compared in blocks of blockSize
+// bytes, a value <= 0 uses 256. The prompt is taken from [WithPrompt].
+func WithPrefixAffinity(blockSize int) QueueOption {
+	return func(q *Queue) {
+		if blockSize <= 0 {
+			blockSize = defaultPrefixBlock
+		}
+		q.prefixBlock = blockSize
+	}
+}
+
+type promptKey struct{}
+
+// WithPrompt returns a copy of ctx carrying the prompt of the request, used
+// for prefix affinity when requesting a slot.
+func WithPrompt(ctx context.Context, prompt string) context.Context {
+	return context.WithValue(ctx, promptKey{}, prompt)
+}
+
+func promptFromContext(ctx context.Context) string {
+	p, _ := ctx.Value(promptKey{}).(string)
+	return p
+}
+
+// prefixHashes returns chained hashes of the complete blocks of prompt, the
+// i-th hash identifies the prefix of i+1 blocks.
+func prefixHashes(prompt string, blockSize int) []uint64 {
+	if blockSize <= 0 {
+		return nil
+	}
+	hashes := make([]uint64, 0, len(prompt)/blockSize)
+	h := fnv.New64a()
+	for i := 0; i+blockSize <= len(prompt); i += blockSize {
+		h.Write([]byte(prompt[i : i+blockSize]))
+		hashes = append(hashes, h.Sum64())
+	}
+	return hashes
+}
+
+// sharedBlocks returns the number of leading blocks a and b have in common.
+func sharedBlocks(a, b []uint64) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package llamacpp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/session"
+)
+
+// Priority is the class a request waits in for a slot. Higher classes are
+// served first.
+type Priority int
+
+const (
+	// PriorityBackground is meant for evaluation and other background work.
+	PriorityBackground Priority = iota
+	// PriorityBatch is meant for batch jobs.
+	PriorityBatch
+	// PriorityInteractive is meant for chat users. It is the default.
+	PriorityInteractive
+)
+
+// PriorityHeader lets a request choose its priority class. A request can only
+// lower the class configured for its token.
+const PriorityHeader = "X-Priority"
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBackground:
+		return "background"
+	case PriorityBatch:
+		return "batch"
+	case PriorityInteractive:
+		return "interactive"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority returns the priority class for its name.
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "background":
+		return PriorityBackground, nil
+	case "batch":
+		return PriorityBatch, nil
+	case "interactive":
+		return PriorityInteractive, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q", s)
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx in which requests for a slot wait in
+// class p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext returns the priority set with [WithPriority], or
+// [PriorityInteractive].
+func PriorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityInteractive
+}
+
+// requestPriority determines the priority of r from the token's
+// session.SessionData and the PriorityHeader.
+func requestPriority(r *http.Request) Priority {
+	p := PriorityInteractive
+	if s, ok := session.FromContext(r.Context()); ok && s.Priority != "" {
+		if sp, err := ParsePriority(s.Priority); err == nil {
+			p = sp
+		}
+	}
+	if h := r.Header.Get(PriorityHeader); h != "" {
+		if hp, err := ParsePriority(h); err == nil && hp < p {
+			p = hp
+		}
+	}
+	return p
+}
@@ -0,0 +1,175 @@
+package llamacpp
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Props is the metadata llama.cpp reports about its loaded model on /props.
+type Props struct {
+	// ChatTemplate is the model's Jinja chat template.
+	ChatTemplate string
+	BOSToken     string
+	EOSToken     string
+	// ContextSize is the context size of each slot of the server.
+	ContextSize int
+	ModelPath   string
+	TotalSlots  int
+}
+
+// llamaProps is the response of llama.cpp's /props endpoint.
+type llamaProps struct {
+	ChatTemplate              string `json:"chat_template"`
+	BOSToken                  string `json:"bos_token"`
+	EOSToken                  string `json:"eos_token"`
+	ModelPath                 string `json:"model_path"`
+	TotalSlots                int    `json:"total_slots"`
+	DefaultGenerationSettings struct {
+		NCtx int `json:"n_ctx"`
+	} `json:"default_generation_settings"`
+}
+
+const (
+	propsRetryMin = time.Second
+	propsRetryMax = time.Minute
+)
+
+// WithPropsDiscovery fetches the model metadata of every endpoint from
+// llama.cpp's /props endpoint, when the queue is created and when an endpoint
+// is added. Endpoints not answering yet are retried until they do. The chat
+// handlers render prompts with the discovered chat template for models
+// without a template of their own.
+func WithPropsDiscovery(timeout time.Duration) QueueOption {
+	return func(q *Queue) {
+		q.propsTimeout = timeout
+	}
+}
+
+// Props returns the metadata discovered for endpoint.
+func (q *Queue) Props(endpoint string) (Props, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	ep, ok := q.endpoints[endpoint]
+	if !ok || ep.props == nil {
+		return Props{}, false
+	}
+	return *ep.props, true
+}
+
+// ModelProps returns the metadata discovered for the endpoints of the queue,
+// which are expected to serve the same model. If they disagree, the metadata
+// of the first endpoint in lexical order is returned.
+func (q *Queue) ModelProps() (Props, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	endpoints := make([]string, 0, len(q.endpoints))
+	for endpoint, ep := range q.endpoints {
+		if ep.props != nil {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		return Props{}, false
+	}
+	sort.Strings(endpoints)
+	return *q.endpoints[endpoints[0]].props, true
+}
+
+// discoverProps fetches the props of endpoint until it succeeds, the
+// endpoint is removed or the queue is closed.
+func (q *Queue) discoverProps(endpoint string) {
+	client := &http.Client{Timeout: q.propsTimeout}
+	retry := propsRetryMin
+	for {
+		props, err := fetchProps(client, endpoint)
+		if err == nil {
+			q.recordProps(endpoint, props)
+			return
+		}
+		slog.Debug("Fetching props failed", "endpoint", endpoint, "error", err)
+		select {
+		case <-q.done:
+			return
+		case <-time.After(retry):
+		}
+		q.mutex.Lock()
+		_, exists := q.endpoints[endpoint]
+		q.mutex.Unlock()
+		if !exists {
+			return
+		}
+		retry = min(2*retry, propsRetryMax)
+	}
+}
+
+// recordProps caches props of endpoint and warns if other endpoints of the
+// queue serve a different model.
+func (q *Queue) recordProps(endpoint string, props Props) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	ep, exists := q.endpoints[endpoint]
+	if !exists {
+		return
+	}
+	ep.props = &props
+	slog.Info("Endpoint props discovered",
+		"endpoint", endpoint, "model", props.ModelPath, "contextSize", props.ContextSize)
+	for other, oep := range q.endpoints {
+		if other == endpoint || oep.props == nil {
+			continue
+		}
+		if diff := propsDiff(props, *oep.props); diff != "" {
+			slog.Warn("Endpoints of a queue disagree on model props",
+				"endpoint", endpoint, "other", other, "field", diff)
+		}
+	}
+}
+
+// propsDiff returns the first field a and b differ in, "" if they are equal.
+func propsDiff(a, b Props) string {
+	switch {
+	case a.ChatTemplate != b.ChatTemplate:
+		return "chat_template"
+	case a.BOSToken != b.BOSToken:
+		return "bos_token"
+	case a.EOSToken != b.EOSToken:
+		return "eos_token"
+	case a.ContextSize != b.ContextSize:
+		return "n_ctx"
+	case a.ModelPath != b.ModelPath:
+		return "model_path"
+	}
+	return ""
+}
+
+func fetchProps(client *http.Client, endpoint string) (Props, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return Props{}, err
+	}
+	resp, err := client.Get(u.ResolveReference(&url.URL{Path: "/props"}).String())
+	if err != nil {
+		return Props{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Props{}, errors.New(resp.Status)
+	}
+	var lp llamaProps
+	if err := json.NewDecoder(resp.Body).Decode(&lp); err != nil {
+		return Props{}, err
+	}
+	return Props{
+		ChatTemplate: lp.ChatTemplate,
+		BOSToken:     lp.BOSToken,
+		EOSToken:     lp.EOSToken,
+		ContextSize:  lp.DefaultGenerationSettings.NCtx,
+		ModelPath:    lp.ModelPath,
+		TotalSlots:   lp.TotalSlots,
+	}, nil
+}
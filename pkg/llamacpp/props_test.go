@@ -0,0 +1,86 @@
+package llamacpp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+func TestPropsDiscovery(t *testing.T) {
+	template := "{% for m in messages %}<{{ m.role }}>{{ m.content }}{{ eos_token }}{% endfor %}" +
+		"{% if add_generation_prompt %}<assistant>{% endif %}"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/props" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"chat_template":%q,"bos_token":"<s>","eos_token":"</s>",`+
+			`"model_path":"model.gguf","total_slots":2,"default_generation_settings":{"n_ctx":4096}}`,
+			template)
+	}))
+	defer server.Close()
+
+	endpoint := server.URL + "/completion"
+	q := NewQueue(
+		[]handler.Endpoint{{Endpoint: endpoint, Parallel: 1}},
+		WithPropsDiscovery(time.Second),
+	)
+	defer q.Close()
+
+	render, err := chatPromptFunc(Model{Queue: q})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := q.ModelProps(); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected props to be discovered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	props, ok := q.Props(endpoint)
+	if !ok {
+		t.Fatalf("expected props of %s", endpoint)
+	}
+	expected := Props{
+		ChatTemplate: template,
+		BOSToken:     "<s>",
+		EOSToken:     "</s>",
+		ContextSize:  4096,
+		ModelPath:    "model.gguf",
+		TotalSlots:   2,
+	}
+	if props != expected {
+		t.Errorf("expected %+v; got %+v", expected, props)
+	}
+
+	prompt, err := render([]openai.Message{{Role: "user", Content: "Hi"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if prompt != "<user>Hi</s><assistant>" {
+		t.Errorf("unexpected prompt %q", prompt)
+	}
+}
+
+func TestPropsDiff(t *testing.T) {
+	a := Props{ChatTemplate: "t", ContextSize: 4096, ModelPath: "a.gguf"}
+	if diff := propsDiff(a, a); diff != "" {
+		t.Errorf("expected no difference; got %s", diff)
+	}
+	b := a
+	b.ContextSize = 8192
+	if diff := propsDiff(a, b); diff != "n_ctx" {
+		t.Errorf("expected n_ctx; got %q", diff)
+	}
+}
@@ -1,25 +1,87 @@
 package llamacpp
 
 import (
-	"math/rand"
+	"context"
+	"errors"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+	"github.com/discovertomorrow/progai-middleware/pkg/session"
 )
 
+// ErrQueueTimeout is returned by [Queue.RequestSlotContext] if no slot became
+// available within the maximum queue wait.
+var ErrQueueTimeout = errors.New("waiting for slot timed out")
+
+// ErrDraining is returned by [Queue.RequestSlotContext] once [Queue.Drain]
+// was called.
+var ErrDraining = errors.New("queue is draining")
+
+// defaultAging is the waiting time after which a request is treated as one
+// priority class higher.
+const defaultAging = 30 * time.Second
+
 type Queue struct {
-	n             int
-	slots         []*Usage
+	n     int
+	slots []*Usage
+	// retired slots belong to a removed endpoint or were cut by a resize. They
+	// are not handed out and can be reused once released.
+	retired []bool
+	// holders of the slots in use, nil for free slots
+	holders       []*slotHolder
 	mutex         sync.Mutex
-	semaphore     chan struct{}
+	waiting       []*waiter
 	endpointSlots []EndpointSlot
+	endpoints     map[string]*queueEndpoint
+	// released is closed and replaced whenever a slot is released
+	released chan struct{}
+	// draining is closed by Drain
+	draining    chan struct{}
+	drainOnce   sync.Once
+	maxWait     time.Duration
+	aging       time.Duration
+	prefixBlock int
+	// fair share: virtual service received per user and the virtual time of
+	// the last served request
+	service map[string]float64
+	virtual float64
+
+	healthCheck *HealthCheck
+	// propsTimeout enables props discovery, see WithPropsDiscovery
+	propsTimeout time.Duration
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// QueueOption configures a [Queue] created by [NewQueue].
+type QueueOption func(*Queue)
+
+// WithMaxWait limits the time a request waits for a free slot. A value <= 0
+// disables the limit, requests then wait until their context is done.
+func WithMaxWait(d time.Duration) QueueOption {
+	return func(q *Queue) {
+		q.maxWait = d
+	}
+}
+
+// WithPriorityAging sets the waiting time after which a request is served as
+// if it was one priority class higher, so low priority work is not starved.
+// A value <= 0 disables aging.
+func WithPriorityAging(d time.Duration) QueueOption {
+	return func(q *Queue) {
+		q.aging = d
+	}
 }
 
 type Slot struct {
 	ID           int
 	endpointSlot EndpointSlot
 	last         Usage
+	// prefixMatch is the number of prompt bytes shared with the previous
+	// prompt of the slot, see [WithPrefixAffinity].
+	prefixMatch int
 }
 
 type EndpointSlot struct {
@@ -31,30 +93,71 @@ type Usage struct {
 	user     int
 	time     int64
 	userSlot int
+	prefix   []uint64
 }
 
-func NewQueue(endpoints []handler.Endpoint) *Queue {
-	n := 0
-	for _, ep := range endpoints {
-		n += ep.Parallel
-	}
+// slotHolder is the request holding a slot.
+type slotHolder struct {
+	user     int
+	userSlot int
+	since    time.Time
+}
+
+// waiter is a request waiting for a slot.
+type waiter struct {
+	user     int
+	userSlot int
+	priority Priority
+	share    string // key of the user for fair sharing
+	weight   float64
+	prefix   []uint64
+	enqueued time.Time
+	ready    chan Slot
+}
+
+// queueEndpoint is the state of an endpoint served by the queue.
+type queueEndpoint struct {
+	parallel int
+	draining bool
+	health   endpointHealth
+	props    *Props
+}
+
+func NewQueue(endpoints []handler.Endpoint, opts ...QueueOption) *Queue {
 	q := Queue{
-		n:             n,
-		slots:         make([]*Usage, n),
-		semaphore:     make(chan struct{}, n),
-		endpointSlots: make([]EndpointSlot, n),
+		endpoints: make(map[string]*queueEndpoint),
+		released:  make(chan struct{}),
+		draining:  make(chan struct{}),
+		aging:     defaultAging,
+		service:   make(map[string]float64),
+		done:      make(chan struct{}),
 	}
-	s := 0
 	for _, ep := range endpoints {
-		for j := 0; j < ep.Parallel; j++ {
-			q.endpointSlots[s] = EndpointSlot{endpoint: ep.Endpoint, slot: j}
-			q.slots[s] = &Usage{user: -1, time: int64(rand.Intn(10001)), userSlot: -1}
-			s += 1
+		q.endpoints[ep.Endpoint] = &queueEndpoint{
+			parallel: ep.Parallel,
+			health:   endpointHealth{healthy: true},
+		}
+		q.addSlots(ep.Endpoint, 0, ep.Parallel)
+	}
+	for _, opt := range opts {
+		opt(&q)
+	}
+	if q.healthCheck != nil {
+		go q.runHealthCheck()
+	}
+	if q.propsTimeout > 0 {
+		for _, ep := range endpoints {
+			go q.discoverProps(ep.Endpoint)
 		}
 	}
 	return &q
 }
 
+// MaxWait returns the maximum time a request waits for a slot, 0 if unlimited.
+func (q *Queue) MaxWait() time.Duration {
+	return q.maxWait
+}
+
 func (q *Queue) ReleaseSlot(s Slot) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -65,33 +168,230 @@ func (q *Queue) ReleaseSlot(s Slot) {
 		user:     s.last.user,
 		time:     time.Now().Unix(),
 		userSlot: s.last.userSlot,
+		prefix:   s.last.prefix,
 	}
 	q.slots[s.ID] = &u
-	<-q.semaphore
+	q.holders[s.ID] = nil
+	close(q.released)
+	q.released = make(chan struct{})
+	q.dispatch()
 }
 
+// RequestSlot blocks until a slot is available. Use [Queue.RequestSlotContext]
+// to stop waiting if the request is cancelled.
 func (q *Queue) RequestSlot(user, userSlot int) Slot {
-	q.semaphore <- struct{}{}
+	s, _ := q.requestSlot(context.Background(), user, userSlot, nil, nil)
+	return s
+}
+
+// RequestSlotContext waits for a slot until one is available, ctx is done,
+// the maximum queue wait is exceeded or the queue is drained. In the latter
+// cases ctx.Err(), [ErrQueueTimeout] or [ErrDraining] is returned and no slot
+// is held.
+//
+// Waiting requests are served by their priority class, see [WithPriority].
+// Within a class, slots are shared fairly between users according to the
+// Weight in their session.SessionData.
+func (q *Queue) RequestSlotContext(ctx context.Context, user, userSlot int) (Slot, error) {
+	var timeout <-chan time.Time
+	if q.maxWait > 0 {
+		timer := time.NewTimer(q.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	return q.requestSlot(ctx, user, userSlot, timeout, q.draining)
+}
+
+func (q *Queue) requestSlot(
+	ctx context.Context,
+	user, userSlot int,
+	timeout <-chan time.Time,
+	draining <-chan struct{},
+) (Slot, error) {
+	if err := ctx.Err(); err != nil {
+		return Slot{}, err
+	}
+	select {
+	case <-draining:
+		return Slot{}, ErrDraining
+	default:
+	}
+	share, weight := fairShare(ctx, user)
+	w := &waiter{
+		user:     user,
+		userSlot: userSlot,
+		priority: PriorityFromContext(ctx),
+		share:    share,
+		weight:   weight,
+		prefix:   prefixHashes(promptFromContext(ctx), q.prefixBlock),
+		enqueued: time.Now(),
+		ready:    make(chan Slot, 1),
+	}
 	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	if q.service[share] < q.virtual {
+		// users returning after being idle start at the current virtual time
+		// and do not get credit for the time they did not wait
+		q.service[share] = q.virtual
+	}
+	q.waiting = append(q.waiting, w)
+	q.dispatch()
+	q.mutex.Unlock()
+
+	var err error
+	select {
+	case s := <-w.ready:
+		return s, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrQueueTimeout
+	case <-draining:
+		err = ErrDraining
+	}
+
+	q.mutex.Lock()
+	removed := q.removeWaiter(w)
+	q.mutex.Unlock()
+	if !removed {
+		// the slot was handed out while we gave up, give it back
+		q.ReleaseSlot(<-w.ready)
+	}
+	return Slot{}, err
+}
+
+// dispatch hands free slots to waiting requests. q.mutex must be held.
+func (q *Queue) dispatch() {
+	defer q.pruneService()
+	for len(q.waiting) > 0 && q.hasFreeSlot() {
+		w := q.nextWaiter(time.Now())
+		q.removeWaiter(w)
+		q.virtual = q.service[w.share]
+		q.service[w.share] += 1 / w.weight
+		w.ready <- q.takeSlot(w.user, w.userSlot, w.prefix)
+	}
+}
 
+// hasFreeSlot reports whether a slot in rotation is free. q.mutex must be
+// held.
+func (q *Queue) hasFreeSlot() bool {
+	for i := range q.n {
+		if q.slots[i] != nil && q.slotInRotation(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// slotInRotation reports whether slot id may be handed out: it is not
+// retired and its endpoint is healthy and not draining. q.mutex must be held.
+func (q *Queue) slotInRotation(id int) bool {
+	if q.retired[id] {
+		return false
+	}
+	ep, ok := q.endpoints[q.endpointSlots[id].endpoint]
+	return ok && ep.health.healthy && !ep.draining
+}
+
+// nextWaiter returns the waiter to be served next: the highest priority
+// class after aging, within a class the user with the least weighted service
+// and the longest waiting request of this user.
+func (q *Queue) nextWaiter(now time.Time) *waiter {
+	var next *waiter
+	nextPriority := 0
+	nextService := 0.0
+	for _, w := range q.waiting {
+		p := int(w.priority)
+		if q.aging > 0 {
+			p += int(now.Sub(w.enqueued) / q.aging)
+		}
+		s := q.service[w.share]
+		if next == nil || p > nextPriority ||
+			(p == nextPriority && s < nextService) ||
+			(p == nextPriority && s == nextService && w.enqueued.Before(next.enqueued)) {
+			next = w
+			nextPriority = p
+			nextService = s
+		}
+	}
+	return next
+}
+
+// pruneService forgets users that are not waiting and have no service ahead
+// of the virtual time, they would be reset on their next request anyway.
+// q.mutex must be held.
+func (q *Queue) pruneService() {
+	if len(q.service) <= 2*len(q.waiting)+16 {
+		return
+	}
+	waiting := make(map[string]bool, len(q.waiting))
+	for _, w := range q.waiting {
+		waiting[w.share] = true
+	}
+	for share, s := range q.service {
+		if !waiting[share] && s <= q.virtual {
+			delete(q.service, share)
+		}
+	}
+}
+
+// fairShare returns the key and weight used to share slots between users.
+// Requests are grouped by the session's UserID, or by user if there is none.
+func fairShare(ctx context.Context, user int) (string, float64) {
+	s, ok := session.FromContext(ctx)
+	if !ok {
+		return "token:" + strconv.Itoa(user), 1
+	}
+	weight := float64(max(s.Weight, 1))
+	if s.UserID != "" {
+		return "user:" + s.UserID, weight
+	}
+	return "token:" + strconv.Itoa(user), weight
+}
+
+// removeWaiter removes w from the waiting list and reports whether it was
+// still waiting. q.mutex must be held.
+func (q *Queue) removeWaiter(w *waiter) bool {
+	for i, o := range q.waiting {
+		if o == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// takeSlot picks a free slot in rotation for user. With prefix affinity the
+// slot sharing the longest prompt prefix is preferred, otherwise the slot last
+// used by user and userSlot, otherwise the least recently used one. q.mutex
+// must be held and a slot must be free, see [Queue.hasFreeSlot].
+func (q *Queue) takeSlot(user, userSlot int, prefix []uint64) Slot {
 	oldest := -1
 	oldestTime := time.Now().Unix() + 1
 	match := -1
+	longest := -1
+	longestBlocks := 0
 	for i := range q.n {
 		u := q.slots[i]
-		if u == nil {
+		if u == nil || !q.slotInRotation(i) {
 			continue
 		}
-		if u.user == user && u.userSlot == userSlot {
+		isUser := u.user == user && u.userSlot == userSlot
+		if shared := sharedBlocks(prefix, u.prefix); shared > longestBlocks ||
+			(shared > 0 && shared == longestBlocks && isUser) {
+			longest = i
+			longestBlocks = shared
+		}
+		if isUser && match == -1 {
 			match = i
-			break
 		}
 		if u.time < oldestTime {
 			oldestTime = u.time
 			oldest = i
 		}
 	}
+	if longest != -1 {
+		match = longest
+	}
 	if match == -1 {
 		if oldest == -1 {
 			// handle error!!!
@@ -106,9 +406,12 @@ func (q *Queue) RequestSlot(user, userSlot int) Slot {
 			user:     user,
 			time:     0,
 			userSlot: userSlot,
+			prefix:   prefix,
 		},
+		prefixMatch: longestBlocks * q.prefixBlock,
 	}
 	q.slots[match] = nil
+	q.holders[match] = &slotHolder{user: user, userSlot: userSlot, since: time.Now()}
 	return s
 }
 
@@ -0,0 +1,234 @@
+package llamacpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+	"github.com/discovertomorrow/progai-middleware/pkg/session"
+)
+
+func TestRequestSlotContext(t *testing.T) {
+	endpoints := []handler.Endpoint{
+		{Endpoint: "http://localhost:8080", Parallel: 1},
+	}
+
+	t.Run("Timeout", func(t *testing.T) {
+		q := NewQueue(endpoints, WithMaxWait(10*time.Millisecond))
+		slot, err := q.RequestSlotContext(context.Background(), 1, -1)
+		if err != nil {
+			t.Fatalf("expected slot; got %v", err)
+		}
+		if _, err := q.RequestSlotContext(context.Background(), 2, -1); !errors.Is(err, ErrQueueTimeout) {
+			t.Errorf("expected ErrQueueTimeout; got %v", err)
+		}
+		q.ReleaseSlot(slot)
+		if _, err := q.RequestSlotContext(context.Background(), 2, -1); err != nil {
+			t.Errorf("expected slot after release; got %v", err)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		q := NewQueue(endpoints)
+		slot, _ := q.RequestSlotContext(context.Background(), 1, -1)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		if _, err := q.RequestSlotContext(ctx, 2, -1); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled; got %v", err)
+		}
+		q.ReleaseSlot(slot)
+		// the cancelled request must not hold the slot
+		if _, err := q.RequestSlotContext(context.Background(), 3, -1); err != nil {
+			t.Errorf("expected slot; got %v", err)
+		}
+	})
+}
+
+func TestRequestSlotPriority(t *testing.T) {
+	endpoints := []handler.Endpoint{
+		{Endpoint: "http://localhost:8080", Parallel: 1},
+	}
+	q := NewQueue(endpoints)
+	slot, _ := q.RequestSlotContext(context.Background(), 0, -1)
+
+	order := make(chan Priority, 3)
+	request := func(p Priority) {
+		s, err := q.RequestSlotContext(WithPriority(context.Background(), p), int(p)+1, -1)
+		if err != nil {
+			t.Errorf("expected slot; got %v", err)
+			return
+		}
+		order <- p
+		q.ReleaseSlot(s)
+	}
+	for _, p := range []Priority{PriorityBackground, PriorityBatch, PriorityInteractive} {
+		go request(p)
+		// make sure requests are enqueued in this order
+		waitForWaiting(q, int(p)+1)
+	}
+	q.ReleaseSlot(slot)
+
+	for _, expected := range []Priority{PriorityInteractive, PriorityBatch, PriorityBackground} {
+		if p := <-order; p != expected {
+			t.Errorf("expected %v; got %v", expected, p)
+		}
+	}
+}
+
+func TestRequestSlotPriorityAging(t *testing.T) {
+	endpoints := []handler.Endpoint{
+		{Endpoint: "http://localhost:8080", Parallel: 1},
+	}
+	q := NewQueue(endpoints, WithPriorityAging(10*time.Millisecond))
+	slot, _ := q.RequestSlotContext(context.Background(), 0, -1)
+
+	got := make(chan Priority, 2)
+	request := func(p Priority) {
+		s, _ := q.RequestSlotContext(WithPriority(context.Background(), p), int(p)+1, -1)
+		got <- p
+		q.ReleaseSlot(s)
+	}
+	go request(PriorityBackground)
+	waitForWaiting(q, 1)
+	// background waited long enough to overtake a new interactive request
+	time.Sleep(50 * time.Millisecond)
+	go request(PriorityInteractive)
+	waitForWaiting(q, 2)
+	q.ReleaseSlot(slot)
+
+	if p := <-got; p != PriorityBackground {
+		t.Errorf("expected aged background request first; got %v", p)
+	}
+	<-got
+}
+
+func waitForWaiting(q *Queue, n int) {
+	for {
+		q.mutex.Lock()
+		l := len(q.waiting)
+		q.mutex.Unlock()
+		if l >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRequestSlotFairShare(t *testing.T) {
+	endpoints := []handler.Endpoint{
+		{Endpoint: "http://localhost:8080", Parallel: 1},
+	}
+
+	run := func(weights map[string]int, requests int) map[string]int {
+		q := NewQueue(endpoints)
+		slot, _ := q.RequestSlotContext(context.Background(), 0, -1)
+
+		served := make(chan string, len(weights)*requests)
+		n := 0
+		for user, weight := range weights {
+			ctx := session.WithToken(
+				context.Background(),
+				session.SessionData{TokenID: len(user), UserID: user, Weight: weight},
+			)
+			for range requests {
+				go func() {
+					s, _ := q.RequestSlotContext(ctx, len(user), -1)
+					served <- user
+					q.ReleaseSlot(s)
+				}()
+				n++
+				waitForWaiting(q, n)
+			}
+		}
+		q.ReleaseSlot(slot)
+
+		counts := make(map[string]int)
+		for range requests {
+			counts[<-served]++
+		}
+		for range n - requests {
+			<-served
+		}
+		return counts
+	}
+
+	t.Run("EqualWeights", func(t *testing.T) {
+		counts := run(map[string]int{"a": 1, "bb": 1, "ccc": 1}, 30)
+		for user, c := range counts {
+			if c != 10 {
+				t.Errorf("expected 10 slots for %s; got %d", user, c)
+			}
+		}
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		counts := run(map[string]int{"a": 2, "bb": 1}, 30)
+		if counts["a"] != 20 || counts["bb"] != 10 {
+			t.Errorf("expected 20/10 slots; got %d/%d", counts["a"], counts["bb"])
+		}
+	})
+}
+
+func TestRequestSlotPrefixAffinity(t *testing.T) {
+	endpoints := []handler.Endpoint{
+		{Endpoint: "http://localhost:8080", Parallel: 3},
+	}
+	q := NewQueue(endpoints, WithPrefixAffinity(4))
+	system := "You are a helpful assistant. "
+
+	// user 1 leaves the shared system prompt in some slot
+	s1, _ := q.RequestSlotContext(WithPrompt(context.Background(), system+"Hi"), 1, -1)
+	q.ReleaseSlot(s1)
+	// user 3 leaves an unrelated prompt in another slot
+	s3, _ := q.RequestSlotContext(WithPrompt(context.Background(), "Translate this text"), 3, -1)
+	q.ReleaseSlot(s3)
+
+	s2, _ := q.RequestSlotContext(WithPrompt(context.Background(), system+"Hello"), 2, -1)
+	if s2.ID != s1.ID {
+		t.Errorf("expected slot %d with shared prefix; got %d", s1.ID, s2.ID)
+	}
+	if s2.prefixMatch != len(system)/4*4 {
+		t.Errorf("expected prefix match of %d bytes; got %d", len(system)/4*4, s2.prefixMatch)
+	}
+}
+
+func TestQueueDrain(t *testing.T) {
+	endpoints := []handler.Endpoint{
+		{Endpoint: "http://localhost:8080", Parallel: 1},
+	}
+	q := NewQueue(endpoints)
+	slot, _ := q.RequestSlotContext(context.Background(), 1, -1)
+
+	waiting := make(chan error)
+	go func() {
+		_, err := q.RequestSlotContext(context.Background(), 2, -1)
+		waiting <- err
+	}()
+	waitForWaiting(q, 1)
+
+	drained := make(chan error)
+	go func() {
+		drained <- q.Drain(context.Background())
+	}()
+	if err := <-waiting; !errors.Is(err, ErrDraining) {
+		t.Errorf("expected waiting request to get ErrDraining; got %v", err)
+	}
+	if _, err := q.RequestSlotContext(context.Background(), 3, -1); !errors.Is(err, ErrDraining) {
+		t.Errorf("expected new request to get ErrDraining; got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected drain to wait for the request in flight; got %v", err)
+	}
+	q.ReleaseSlot(slot)
+	if err := <-drained; err != nil {
+		t.Errorf("expected drain to finish; got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package llamacpp
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+// maxTopLogprobs is the maximum of top_logprobs OpenAI accepts.
+const maxTopLogprobs = 20
+
+// paramError is an invalid parameter of a chat request.
+type paramError struct {
+	param   string
+	message string
+}
+
+func (e *paramError) Error() string {
+	return e.message
+}
+
+// completionRequest translates the sampling parameters and the response
+// format of chatReq into a llama.cpp request for prompt. Parameters llama.cpp
+// cannot honor are rejected with a [paramError].
+func (cm *chatModel) completionRequest(chatReq openai.ChatRequest, prompt string) (Request, error) {
+	if chatReq.N != nil && *chatReq.N != 1 {
+		return Request{}, &paramError{"n", "Only n=1 is supported."}
+	}
+	if choice := chatReq.ToolChoice; choice.Mode == "function" && !hasTool(chatReq.Tools, choice.Function) {
+		return Request{}, &paramError{
+			"tool_choice",
+			fmt.Sprintf("Function %q of tool_choice is not one of the tools.", choice.Function),
+		}
+	}
+	logitBias, err := mergeLogitBias(cm.logitBias, chatReq.LogitBias)
+	if err != nil {
+		return Request{}, err
+	}
+	nProbs := 0
+	if chatReq.Logprobs {
+		nProbs = 1
+		if chatReq.TopLogprobs != nil {
+			if *chatReq.TopLogprobs < 0 || *chatReq.TopLogprobs > maxTopLogprobs {
+				return Request{}, &paramError{
+					"top_logprobs",
+					fmt.Sprintf("top_logprobs must be between 0 and %d.", maxTopLogprobs),
+				}
+			}
+			nProbs = max(*chatReq.TopLogprobs, 1)
+		}
+	} else if chatReq.TopLogprobs != nil {
+		return Request{}, &paramError{"top_logprobs", "top_logprobs requires logprobs to be true."}
+	}
+	grammar, err := responseFormatGrammar(chatReq.ResponseFormat)
+	if err != nil {
+		return Request{}, err
+	}
+	req := Request{
+		Prompt:           prompt,
+		Stream:           chatReq.Stream,
+		NPredict:         chatReq.MaxTokens,
+		Temperature:      chatReq.Temperature,
+		TopP:             chatReq.TopP,
+		PresencePenalty:  chatReq.PresencePenalty,
+		FrequencyPenalty: chatReq.FrequencyPenalty,
+		Seed:             chatReq.Seed,
+		CachePrompt:      true,
+		Stop:             mergeStop(cm.stop, chatReq.Stop),
+		LogitBias:        logitBias,
+		NProbs:           nProbs,
+	}
+	if grammar != "" {
+		req.Grammar = &grammar
+	}
+	return req, nil
+}
+
+// mergeStop returns the stop sequences of the model followed by the ones of
+// the request not already contained.
+func mergeStop(model []string, request []string) []string {
+	stop := append([]string{}, model...)
+	for _, s := range request {
+		if s != "" && !contains(stop, s) {
+			stop = append(stop, s)
+		}
+	}
+	return stop
+}
+
+// mergeLogitBias returns the biases of the model, overridden and extended by
+// the biases of the request, which map token ids to biases.
+func mergeLogitBias(model [][2]float64, request map[string]float64) ([][2]float64, error) {
+	biases := map[int]float64{}
+	for _, b := range model {
+		biases[int(b[0])] = b[1]
+	}
+	for token, bias := range request {
+		id, err := strconv.Atoi(token)
+		if err != nil || id < 0 {
+			return nil, &paramError{"logit_bias", fmt.Sprintf("Invalid token id %q in logit_bias.", token)}
+		}
+		if bias < -100 || bias > 100 {
+			return nil, &paramError{"logit_bias", fmt.Sprintf("Bias of token %d must be between -100 and 100.", id)}
+		}
+		biases[id] = bias
+	}
+	ids := make([]int, 0, len(biases))
+	for id := range biases {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var merged [][2]float64
+	for _, id := range ids {
+		merged = append(merged, [2]float64{float64(id), biases[id]})
+	}
+	return merged, nil
+}
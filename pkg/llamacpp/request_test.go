@@ -0,0 +1,74 @@
+package llamacpp
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+func TestCompletionRequest(t *testing.T) {
+	cm := &chatModel{
+		stop:      []string{"</s>"},
+		logitBias: [][2]float64{{523, -10}, {28789, -10}},
+	}
+	var chatReq openai.ChatRequest
+	if err := json.Unmarshal([]byte(`{
+		"max_completion_tokens": 64,
+		"stop": ["</s>", "\n\n"],
+		"seed": 42,
+		"presence_penalty": 0.5,
+		"frequency_penalty": 0.25,
+		"logit_bias": {"28789": 5, "100": -100},
+		"logprobs": true,
+		"top_logprobs": 3,
+		"n": 1
+	}`), &chatReq); err != nil {
+		t.Fatalf("decoding request: %v", err)
+	}
+	cm.applyDefaults(&chatReq)
+
+	req, err := cm.completionRequest(chatReq, "prompt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.NPredict != 64 {
+		t.Errorf("expected n_predict 64; got %d", req.NPredict)
+	}
+	if expected := []string{"</s>", "\n\n"}; !reflect.DeepEqual(req.Stop, expected) {
+		t.Errorf("expected stop %q; got %q", expected, req.Stop)
+	}
+	if req.Seed == nil || *req.Seed != 42 {
+		t.Errorf("expected seed 42; got %v", req.Seed)
+	}
+	if req.PresencePenalty == nil || *req.PresencePenalty != 0.5 ||
+		req.FrequencyPenalty == nil || *req.FrequencyPenalty != 0.25 {
+		t.Errorf("expected penalties 0.5 and 0.25; got %v and %v", req.PresencePenalty, req.FrequencyPenalty)
+	}
+	if expected := [][2]float64{{100, -100}, {523, -10}, {28789, 5}}; !reflect.DeepEqual(req.LogitBias, expected) {
+		t.Errorf("expected logit bias %v; got %v", expected, req.LogitBias)
+	}
+	if req.NProbs != 3 {
+		t.Errorf("expected n_probs 3; got %d", req.NProbs)
+	}
+
+	for param, input := range map[string]string{
+		"n":            `{"n": 2}`,
+		"logit_bias":   `{"logit_bias": {"token": 1}}`,
+		"top_logprobs": `{"top_logprobs": 2}`,
+		"tool_choice": `{"tools": [{"type": "function", "function": {"name": "a"}}],
+			"tool_choice": {"type": "function", "function": {"name": "b"}}}`,
+	} {
+		var chatReq openai.ChatRequest
+		if err := json.Unmarshal([]byte(input), &chatReq); err != nil {
+			t.Fatalf("decoding %s: %v", input, err)
+		}
+		_, err := cm.completionRequest(chatReq, "prompt")
+		var invalid *paramError
+		if !errors.As(err, &invalid) || invalid.param != param {
+			t.Errorf("expected invalid %s for %s; got %v", param, input, err)
+		}
+	}
+}
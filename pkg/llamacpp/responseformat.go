@@ -0,0 +1,167 @@
+package llamacpp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+// maxStrictAttempts limits the generations for a strict json_schema response
+// format until the output matches the schema.
+const maxStrictAttempts = 3
+
+// responseFormatGrammar returns the grammar constraining the output to rf,
+// "" if the output is not constrained.
+func responseFormatGrammar(rf *openai.ResponseFormat) (string, error) {
+	if rf == nil {
+		return "", nil
+	}
+	switch rf.Type {
+	case "", "text":
+		return "", nil
+	case "json_object":
+		g := newGrammarBuilder()
+		root := g.add("root", "")
+		g.rules[root] = g.primitive("object")
+		return g.String(), nil
+	case "json_schema":
+		if rf.JSONSchema == nil || rf.JSONSchema.Schema == nil {
+			return "", &paramError{"response_format", "json_schema requires a schema."}
+		}
+		g := newGrammarBuilder()
+		root := g.add("root", "")
+		// the primitive rule value matches any JSON value, so the schema's
+		// rule needs a name of its own
+		g.rules[root] = g.schemaRule("root-value", *rf.JSONSchema.Schema)
+		return g.String(), nil
+	}
+	return "", &paramError{
+		"response_format",
+		fmt.Sprintf("Invalid response_format type %q, expected text, json_object or json_schema.", rf.Type),
+	}
+}
+
+// strictSchema returns the schema the output has to match, nil if rf is not
+// a strict json_schema.
+func strictSchema(rf *openai.ResponseFormat) *openai.Schema {
+	if rf == nil || rf.Type != "json_schema" || rf.JSONSchema == nil || !rf.JSONSchema.Strict {
+		return nil
+	}
+	return rf.JSONSchema.Schema
+}
+
+// schemaMismatchError is returned by generateStrict if no output matched the
+// schema.
+type schemaMismatchError struct {
+	err error
+}
+
+func (e *schemaMismatchError) Error() string {
+	return fmt.Sprintf(
+		"The model's output did not match the schema after %d attempts: %v", maxStrictAttempts, e.err)
+}
+
+// generateStrict generates the completion for req until its output matches
+// schema, at most maxStrictAttempts times. The grammar of req enforces the
+// structure of the schema but not keywords like pattern or minimum.
+func generateStrict(
+	llama func(Request, func([]byte) bool, bool) error,
+	l *slog.Logger,
+	req Request,
+	schema openai.Schema,
+) (string, *string, *openai.ChatResponseUsage, error) {
+	req.Stream = false
+	var mismatch error
+	for attempt := 0; attempt < maxStrictAttempts; attempt++ {
+		if req.Seed != nil && attempt > 0 {
+			// the same seed would reproduce the same output
+			seed := *req.Seed + 1
+			req.Seed = &seed
+		}
+		content := strings.Builder{}
+		var finish_reason *string
+		var usage *openai.ChatResponseUsage
+		var parseErr error
+		if err := llama(req, func(line []byte) bool {
+			c, f, u, err := extractFromLlamaLine(line)
+			if err != nil {
+				parseErr = err
+				return false
+			}
+			content.WriteString(c)
+			if f != nil {
+				finish_reason = f
+			}
+			if u != nil {
+				usage = u
+			}
+			return true
+		}, false); err != nil {
+			return "", nil, nil, err
+		}
+		if parseErr != nil {
+			return "", nil, nil, parseErr
+		}
+		mismatch = schema.Validate([]byte(content.String()))
+		if mismatch == nil {
+			return content.String(), finish_reason, usage, nil
+		}
+		l.Info("Output does not match schema", "attempt", attempt+1, "error", mismatch)
+	}
+	return "", nil, nil, &schemaMismatchError{mismatch}
+}
+
+// serveStrict answers a request with a strict json_schema response format.
+// As the output has to be validated before it is returned, a streamed
+// response has the whole content in a single chunk.
+func serveStrict(
+	w http.ResponseWriter,
+	llama func(Request, func([]byte) bool, bool) error,
+	l *slog.Logger,
+	req Request,
+	schema openai.Schema,
+	stream bool,
+	streamIncludeUsage bool,
+	llamacppRequestId string,
+	model string,
+) {
+	content, finish_reason, usage, err := generateStrict(llama, l, req, schema)
+	if err != nil {
+		l.Info("Error generating strict response", "error", err)
+		var mismatch *schemaMismatchError
+		if errors.As(err, &mismatch) {
+			openai.WriteError(
+				w, http.StatusInternalServerError, mismatch.Error(),
+				"server_error", "response_format", "")
+			return
+		}
+		writeBackendError(w, err)
+		return
+	}
+	msg := openai.ChatCompletionMessage{Role: "assistant", Content: &content}
+	if !stream {
+		if err := writeChatCompletionResponse(
+			w, false, llamacppRequestId, model, msg, finish_reason, nil, true, false, usage,
+		); err != nil {
+			l.Info("Error writing response", "error", err)
+		}
+		return
+	}
+	if err := writeChatCompletionResponse(
+		w, true, llamacppRequestId, model, msg, nil, nil, true, streamIncludeUsage, nil,
+	); err != nil {
+		l.Info("Error writing response", "error", err)
+		return
+	}
+	if err := writeChatCompletionResponse(
+		w, true, llamacppRequestId, model, msg, finish_reason, nil, false, streamIncludeUsage, usage,
+	); err != nil {
+		l.Info("Error writing response", "error", err)
+		return
+	}
+	w.Write([]byte("\ndata: [DONE]"))
+}
@@ -0,0 +1,98 @@
+package llamacpp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+func TestResponseFormatGrammar(t *testing.T) {
+	grammar, err := responseFormatGrammar(&openai.ResponseFormat{Type: "json_object"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(grammar, "root ::= object\n") {
+		t.Errorf("expected root to be an object; got\n%s", grammar)
+	}
+
+	var rf openai.ResponseFormat
+	if err := json.Unmarshal([]byte(`{"type": "json_schema", "json_schema": {"name": "answer", "strict": true,
+		"schema": {"type": "object", "properties": {"answer": {"type": "string"}}, "required": ["answer"]}}}`),
+		&rf); err != nil {
+		t.Fatalf("decoding response format: %v", err)
+	}
+	grammar, err = responseFormatGrammar(&rf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(grammar, "root ::= root-value-object\n") || !strings.Contains(grammar, `"\"answer\""`) {
+		t.Errorf("expected grammar of the schema; got\n%s", grammar)
+	}
+	if strictSchema(&rf) == nil {
+		t.Errorf("expected strict schema")
+	}
+
+	// a nullable object must not replace the rule for free-form values
+	if err := json.Unmarshal([]byte(`{"type": "json_schema", "json_schema": {"name": "x",
+		"schema": {"type": ["object", "null"], "properties": {"x": {}}, "required": ["x"]}}}`),
+		&rf); err != nil {
+		t.Fatalf("decoding response format: %v", err)
+	}
+	grammar, err = responseFormatGrammar(&rf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(grammar, "root ::= root-value\n") ||
+		!strings.Contains(grammar, "\nroot-value ::= root-value-object | null\n") ||
+		!strings.Contains(grammar, "\nvalue ::= "+grammarPrimitives["value"]+"\n") {
+		t.Errorf("expected the built-in value rule to be kept; got\n%s", grammar)
+	}
+
+	for _, rf := range []openai.ResponseFormat{{Type: "json_schema"}, {Type: "xml"}} {
+		var invalid *paramError
+		if _, err := responseFormatGrammar(&rf); !errors.As(err, &invalid) {
+			t.Errorf("expected invalid response_format for %+v; got %v", rf, err)
+		}
+	}
+}
+
+func TestGenerateStrict(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var schema openai.Schema
+	if err := json.Unmarshal([]byte(`{"type": "object", "properties": {"n": {"type": "integer", "maximum": 9}},
+		"required": ["n"]}`), &schema); err != nil {
+		t.Fatalf("decoding schema: %v", err)
+	}
+	respond := func(outputs ...string) (func(Request, func([]byte) bool, bool) error, *int) {
+		calls := 0
+		return func(req Request, yield func([]byte) bool, stream bool) error {
+			line, _ := json.Marshal(map[string]interface{}{
+				"content": outputs[calls], "stop": true, "stopped_eos": true,
+			})
+			calls++
+			yield(line)
+			return nil
+		}, &calls
+	}
+
+	llama, calls := respond(`{"n": 42}`, `{"n": 7}`)
+	content, finish_reason, _, err := generateStrict(llama, l, Request{}, schema)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content != `{"n": 7}` || *calls != 2 || finish_reason == nil || *finish_reason != "stop" {
+		t.Errorf("expected the second output; got %q after %d calls", content, *calls)
+	}
+
+	llama, _ = respond(`{"n": 42}`, `{"n": 10}`, `{}`)
+	_, _, _, err = generateStrict(llama, l, Request{}, schema)
+	var mismatch *schemaMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Errorf("expected schemaMismatchError; got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package llamacpp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/logging"
+)
+
+// QueueStatus is a snapshot of a [Queue].
+type QueueStatus struct {
+	Waiting           int              `json:"waiting"`
+	WaitingByPriority map[string]int   `json:"waiting_by_priority"`
+	Endpoints         []EndpointStatus `json:"endpoints"`
+	Slots             []SlotStatus     `json:"slots"`
+}
+
+// EndpointStatus is the state of an endpoint in a [QueueStatus].
+type EndpointStatus struct {
+	Endpoint string `json:"endpoint"`
+	Parallel int    `json:"parallel"`
+	Healthy  bool   `json:"healthy"`
+	Draining bool   `json:"draining"`
+	InFlight int    `json:"in_flight"`
+}
+
+// SlotStatus is the state of a slot in a [QueueStatus]. User and UserSlot
+// are the current holder of a busy slot, otherwise its last user.
+type SlotStatus struct {
+	ID           int        `json:"id"`
+	Endpoint     string     `json:"endpoint"`
+	EndpointSlot int        `json:"endpoint_slot"`
+	Busy         bool       `json:"busy"`
+	Retired      bool       `json:"retired"`
+	User         int        `json:"user"`
+	UserSlot     int        `json:"user_slot"`
+	HeldSince    *time.Time `json:"held_since,omitempty"`
+	HeldSeconds  float64    `json:"held_seconds,omitempty"`
+	LastUsed     *time.Time `json:"last_used,omitempty"`
+}
+
+// Status returns a consistent snapshot of the queue.
+func (q *Queue) Status() QueueStatus {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := time.Now()
+
+	status := QueueStatus{
+		Waiting:           len(q.waiting),
+		WaitingByPriority: make(map[string]int),
+		Endpoints:         make([]EndpointStatus, 0, len(q.endpoints)),
+		Slots:             make([]SlotStatus, 0, q.n),
+	}
+	for _, w := range q.waiting {
+		status.WaitingByPriority[w.priority.String()]++
+	}
+	for endpoint, ep := range q.endpoints {
+		status.Endpoints = append(status.Endpoints, EndpointStatus{
+			Endpoint: endpoint,
+			Parallel: ep.parallel,
+			Healthy:  ep.health.healthy,
+			Draining: ep.draining,
+			InFlight: q.inFlight(endpoint),
+		})
+	}
+	sort.Slice(status.Endpoints, func(i, j int) bool {
+		return status.Endpoints[i].Endpoint < status.Endpoints[j].Endpoint
+	})
+	for i := range q.n {
+		if q.retired[i] && q.slots[i] != nil {
+			// reusable entry, not a slot anymore
+			continue
+		}
+		eps := q.endpointSlots[i]
+		s := SlotStatus{
+			ID:           i,
+			Endpoint:     eps.endpoint,
+			EndpointSlot: eps.slot,
+			Retired:      q.retired[i],
+		}
+		if h := q.holders[i]; h != nil {
+			since := h.since
+			s.Busy = true
+			s.User = h.user
+			s.UserSlot = h.userSlot
+			s.HeldSince = &since
+			s.HeldSeconds = now.Sub(since).Seconds()
+		} else if u := q.slots[i]; u != nil {
+			s.User = u.user
+			s.UserSlot = u.userSlot
+			if u.user != -1 {
+				lastUsed := time.Unix(u.time, 0)
+				s.LastUsed = &lastUsed
+			}
+		}
+		status.Slots = append(status.Slots, s)
+	}
+	return status
+}
+
+// NewQueueStatusHandler serves the [QueueStatus] of queue as JSON. It is meant
+// for operators and should not be exposed publicly.
+func NewQueueStatusHandler(queue *Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := logging.FromContext(r.Context()).With("function", "handler.<queue status handler>")
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(queue.Status()); err != nil {
+			l.Info("Error writing queue status", "error", err)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package llamacpp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/handler"
+)
+
+func TestQueueStatusHandler(t *testing.T) {
+	q := NewQueue([]handler.Endpoint{{Endpoint: "http://localhost:8080", Parallel: 2}})
+	slot, _ := q.RequestSlotContext(context.Background(), 7, 3)
+
+	w := httptest.NewRecorder()
+	NewQueueStatusHandler(q).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	var status QueueStatus
+	if err := json.NewDecoder(w.Result().Body).Decode(&status); err != nil {
+		t.Fatalf("decoding status: %v", err)
+	}
+	if len(status.Slots) != 2 || len(status.Endpoints) != 1 || status.Endpoints[0].InFlight != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	busy := status.Slots[slot.ID]
+	if !busy.Busy || busy.User != 7 || busy.UserSlot != 3 || busy.HeldSince == nil {
+		t.Errorf("expected slot held by user 7/3; got %+v", busy)
+	}
+
+	q.ReleaseSlot(slot)
+	released := q.Status().Slots[slot.ID]
+	if released.Busy || released.User != 7 || released.LastUsed == nil {
+		t.Errorf("expected slot last used by user 7; got %+v", released)
+	}
+}
@@ -0,0 +1,194 @@
+package llamacpp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+// ErrUnknownChatTemplate is returned for chat template presets not built in.
+var ErrUnknownChatTemplate = errors.New("unknown chat template")
+
+// ChatTemplatePreset is a built-in chat template with the stop sequences of
+// its model family. Presets leave out the BOS token, which llama.cpp adds when
+// tokenizing the prompt, but render the EOS tokens ending assistant turns.
+// They render conversations like the official templates of Qwen2.5 (chatml),
+// Llama 3.1, Mistral v0.3 and Zephyr, but also render what those reject or
+// leave out: parallel tool calls for llama3 and tool messages for zephyr.
+type ChatTemplatePreset struct {
+	Name     string
+	Template string
+	Stop     []string
+}
+
+var chatTemplatePresets = map[string]ChatTemplatePreset{
+	"chatml": {
+		Name: "chatml",
+		Template: `{{- $tool := false }}
+{{- range . }}
+{{- if eq .Role "tool" }}
+{{- if not $tool }}<|im_start|>user{{ end }}
+<tool_response>
+{{ .Content }}
+</tool_response>{{ $tool = true }}
+{{- else }}
+{{- if $tool }}<|im_end|>
+{{ $tool = false }}{{ end }}<|im_start|>{{ .Role }}
+{{- if .ToolCalls }}{{ if .Content }}
+{{ .Content }}{{ end }}{{ range .ToolCalls }}
+<tool_call>
+{"name": {{ json .Function.Name }}, "arguments": {{ or .Function.Arguments "{}" }}}
+</tool_call>
+{{- end }}
+{{- else }}
+{{ .Content }}{{ end }}<|im_end|>
+{{ end }}
+{{- end }}
+{{- if $tool }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`,
+		Stop: []string{"<|im_end|>"},
+	},
+	"llama3": {
+		Name: "llama3",
+		Template: `{{- $system := "" }}
+{{- range $i, $m := . }}{{ if and (eq $i 0) (eq .Role "system") }}{{ $system = trim .Content }}{{ end }}{{ end -}}
+<|start_header_id|>system<|end_header_id|>
+
+Cutting Knowledge Date: December 2023
+Today Date: 26 Jul 2024
+
+{{ $system }}<|eot_id|>
+{{- range $i, $m := . }}
+{{- if and (eq $i 0) (eq .Role "system") }}
+{{- else if eq .Role "tool" }}<|start_header_id|>ipython<|end_header_id|>
+
+{{ json .Content }}<|eot_id|>
+{{- else if .ToolCalls }}<|start_header_id|>assistant<|end_header_id|>
+
+{{ range $j, $tc := .ToolCalls }}{{ if $j }}
+{{ end }}{"name": {{ json .Function.Name }}, "parameters": {{ or .Function.Arguments "{}" }}}{{ end }}<|eot_id|>
+{{- else }}<|start_header_id|>{{ .Role }}<|end_header_id|>
+
+{{ trim .Content }}<|eot_id|>
+{{- end }}
+{{- end }}<|start_header_id|>assistant<|end_header_id|>
+
+`,
+		Stop: []string{"<|eot_id|>", "<|eom_id|>"},
+	},
+	"mistral": {
+		Name: "mistral",
+		Template: `{{- $system := "" }}
+{{- range $i, $m := . }}
+{{- if and (eq $i 0) (eq .Role "system") }}{{ $system = .Content }}
+{{- else if eq .Role "user" }}[INST] {{ if and $system (eq (len (slice $ $i)) 1) }}{{ $system }}
+
+{{ end }}{{ .Content }}[/INST]
+{{- else if eq .Role "tool" }}[TOOL_RESULTS] {"content": {{ .Content }}, "call_id": {{ json .ToolCallID }}}[/TOOL_RESULTS]
+{{- else if .ToolCalls }}[TOOL_CALLS] [
+{{- range $j, $tc := .ToolCalls }}{{ if $j }}, {{ end }}{"arguments": {{ or .Function.Arguments "{}" }}, "name": {{ json .Function.Name }}, "id": {{ json .Id }}}{{ end -}}
+]</s>
+{{- else }} {{ trim .Content }}</s>
+{{- end }}
+{{- end }}`,
+		Stop: []string{"[INST]"},
+	},
+	"zephyr": {
+		Name: "zephyr",
+		Template: `{{- range . }}<|{{ .Role }}|>
+{{- if .Content }}
+{{ .Content }}{{ end }}
+{{- with .ToolCalls }}{{ range . }}
+<tool_call>
+{"name": {{ json .Function.Name }}, "arguments": {{ or .Function.Arguments "{}" }}}
+</tool_call>
+{{- end }}{{ end }}</s>
+{{ end }}<|assistant|>
+`,
+		Stop: []string{"</s>", "<|user|>"},
+	},
+}
+
+// ChatTemplateByName returns the built-in chat template preset name.
+func ChatTemplateByName(name string) (ChatTemplatePreset, error) {
+	preset, ok := chatTemplatePresets[strings.ToLower(name)]
+	if !ok {
+		return ChatTemplatePreset{}, fmt.Errorf("%w: %s", ErrUnknownChatTemplate, name)
+	}
+	return preset, nil
+}
+
+// ChatTemplatePresets returns all built-in chat template presets sorted by
+// name.
+func ChatTemplatePresets() []ChatTemplatePreset {
+	presets := make([]ChatTemplatePreset, 0, len(chatTemplatePresets))
+	for _, preset := range chatTemplatePresets {
+		presets = append(presets, preset)
+	}
+	sort.Slice(presets, func(i, j int) bool { return presets[i].Name < presets[j].Name })
+	return presets
+}
+
+// chatTemplateFuncs are available in all chat templates.
+var chatTemplateFuncs = template.FuncMap{
+	"json": templateJSON,
+	"trim": func(v interface{}) string { return strings.TrimSpace(fmt.Sprint(v)) },
+}
+
+// templateJSON encodes v as JSON without escaping HTML characters.
+func templateJSON(v interface{}) (string, error) {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// jinjaMessages converts msgs to the messages of Jinja chat templates, as
+// transformers passes them: tool call arguments are objects and missing
+// fields are undefined.
+func jinjaMessages(msgs []openai.Message) []interface{} {
+	messages := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		m := map[string]interface{}{
+			"role":    msg.Role,
+			"content": string(msg.Content),
+		}
+		if msg.Name != nil {
+			m["name"] = *msg.Name
+		}
+		if msg.ToolCallID != nil {
+			m["tool_call_id"] = *msg.ToolCallID
+		}
+		if msg.ToolCalls != nil {
+			calls := make([]interface{}, len(*msg.ToolCalls))
+			for j, tc := range *msg.ToolCalls {
+				var arguments interface{} = tc.Function.Arguments
+				var decoded map[string]interface{}
+				if json.Unmarshal([]byte(tc.Function.Arguments), &decoded) == nil {
+					arguments = decoded
+				}
+				calls[j] = map[string]interface{}{
+					"id":   tc.Id,
+					"type": "function",
+					"function": map[string]interface{}{
+						"name":      tc.Function.Name,
+						"arguments": arguments,
+					},
+				}
+			}
+			m["tool_calls"] = calls
+		}
+		messages[i] = m
+	}
+	return messages
+}
@@ -0,0 +1,154 @@
+package llamacpp
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// templateConversation covers all roles, parallel tool calls and their
+// results. Tool call ids have nine characters and arguments are formatted
+// like tojson, as the official templates expect.
+func templateConversation() []openai.Message {
+	id := func(s string) *string { return &s }
+	return []openai.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "What is the weather in Berlin and Paris?"},
+		{Role: "assistant", ToolCalls: &[]openai.ToolCall{
+			{Id: "call00001", Type: "function", Function: openai.ChatCompletionFunction{
+				Name: "weather", Arguments: `{"city": "Berlin"}`}},
+			{Id: "call00002", Type: "function", Function: openai.ChatCompletionFunction{
+				Name: "weather", Arguments: `{"city": "Paris"}`}},
+		}},
+		{Role: "tool", Content: `{"temperature": 21}`, ToolCallID: id("call00001")},
+		{Role: "tool", Content: `{"temperature": 24}`, ToolCallID: id("call00002")},
+		{Role: "assistant", Content: "It is 21°C in Berlin and 24°C in Paris."},
+		{Role: "user", Content: "Thanks!"},
+	}
+}
+
+// sequentialConversation is templateConversation with one tool call per
+// assistant message.
+func sequentialConversation() []openai.Message {
+	msgs := templateConversation()
+	calls := *msgs[2].ToolCalls
+	return []openai.Message{
+		msgs[0], msgs[1],
+		{Role: "assistant", ToolCalls: &[]openai.ToolCall{calls[0]}}, msgs[3],
+		{Role: "assistant", ToolCalls: &[]openai.ToolCall{calls[1]}}, msgs[4],
+		msgs[5], msgs[6],
+	}
+}
+
+// toollessConversation is templateConversation without tool calls and
+// results.
+func toollessConversation() []openai.Message {
+	var msgs []openai.Message
+	for _, msg := range templateConversation() {
+		if msg.Role != "tool" && msg.ToolCalls == nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// officialTemplates are the chat templates the presets are ported from, in
+// testdata/templates/<preset>.jinja: Qwen2.5-Instruct for chatml,
+// Llama-3.1-Instruct, Mistral-7B-Instruct-v0.3 and zephyr-7b-beta. The
+// golden files are rendered from them. Llama 3.1 rejects parallel tool calls
+// and Zephyr has no tool roles, so their presets are compared on the part of
+// the conversation the official template supports.
+var officialTemplates = map[string]struct {
+	eos          string
+	conversation func() []openai.Message
+}{
+	"chatml":  {"<|im_end|>", templateConversation},
+	"llama3":  {"<|eot_id|>", sequentialConversation},
+	"mistral": {"</s>", templateConversation},
+	"zephyr":  {"</s>", toollessConversation},
+}
+
+// renderOfficialTemplate renders the conversation of the official template
+// of the preset name with the template as Jinja model.
+func renderOfficialTemplate(t *testing.T, name string) string {
+	t.Helper()
+	official := officialTemplates[name]
+	source, err := os.ReadFile(filepath.Join("testdata", "templates", name+".jinja"))
+	if err != nil {
+		t.Fatalf("reading official template: %v", err)
+	}
+	cm, err := newChatModel(Model{JinjaTemplate: string(source), EOSToken: official.eos})
+	if err != nil {
+		t.Fatalf("parsing official template: %v", err)
+	}
+	prompt, err := cm.prepareChatPrompt(official.conversation())
+	if err != nil {
+		t.Fatalf("rendering official template: %v", err)
+	}
+	return prompt
+}
+
+func TestChatTemplatePresets(t *testing.T) {
+	for _, preset := range ChatTemplatePresets() {
+		t.Run(preset.Name, func(t *testing.T) {
+			official, ok := officialTemplates[preset.Name]
+			if !ok {
+				t.Fatalf("no official template of the preset")
+			}
+			golden := filepath.Join("testdata", "templates", preset.Name+".golden")
+			if *updateGolden {
+				prompt := renderOfficialTemplate(t, preset.Name)
+				if err := os.WriteFile(golden, []byte(prompt), 0o644); err != nil {
+					t.Fatalf("writing golden file: %v", err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("reading golden file: %v", err)
+			}
+
+			cm, err := newChatModel(Model{Template: preset.Name})
+			if err != nil {
+				t.Fatalf("parsing template: %v", err)
+			}
+			if len(cm.stop) == 0 {
+				t.Errorf("expected stop sequences of the preset")
+			}
+			prompt, err := cm.prepareChatPrompt(official.conversation())
+			if err != nil {
+				t.Fatalf("rendering template: %v", err)
+			}
+			if prompt != string(expected) {
+				t.Errorf("expected prompt\n%s\ngot\n%s", expected, prompt)
+			}
+		})
+	}
+
+	if _, err := newChatModel(Model{Template: "unknown"}); err == nil {
+		t.Errorf("expected an error for an unknown template")
+	}
+}
+
+func TestJinjaChatTemplate(t *testing.T) {
+	for name := range officialTemplates {
+		t.Run(name, func(t *testing.T) {
+			prompt := renderOfficialTemplate(t, name)
+			expected, err := os.ReadFile(filepath.Join("testdata", "templates", name+".golden"))
+			if err != nil {
+				t.Fatalf("reading golden file: %v", err)
+			}
+			if prompt != string(expected) {
+				t.Errorf("expected prompt\n%s\ngot\n%s", expected, prompt)
+			}
+		})
+	}
+
+	if _, err := newChatModel(Model{ChatTemplate: "{{ . }}", JinjaTemplate: "{{ messages }}"}); err == nil {
+		t.Errorf("expected an error for a model with two templates")
+	}
+}
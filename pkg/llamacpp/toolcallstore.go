@@ -0,0 +1,291 @@
+package llamacpp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+	"github.com/discovertomorrow/progai-middleware/pkg/session"
+)
+
+// DefaultToolCallTTL is how long tool calls are kept by default.
+const DefaultToolCallTTL = 6 * time.Hour
+
+// StoredToolCall is a tool call generated by a model, kept so later turns of
+// the conversation can refer to it by its id. Only its owner may refer to it.
+type StoredToolCall struct {
+	Id        string        `json:"id"`
+	Name      string        `json:"name"`
+	Arguments string        `json:"arguments"`
+	Model     string        `json:"model"`
+	Owner     ToolCallOwner `json:"owner"`
+	Created   time.Time     `json:"created"`
+}
+
+// ToolCallOwner is the session a tool call was generated for.
+type ToolCallOwner struct {
+	TokenID int    `json:"token_id"`
+	UserID  string `json:"user_id"`
+}
+
+// toolCallOwner returns the owner of tool calls generated in ctx. Requests
+// without session share the zero owner.
+func toolCallOwner(ctx context.Context) ToolCallOwner {
+	s, _ := session.FromContext(ctx)
+	return ToolCallOwner{TokenID: s.TokenID, UserID: s.UserID}
+}
+
+// ToolCallStore keeps generated tool calls. Implementations must be safe for
+// concurrent use. Stores shared by several replicas let any of them continue
+// a conversation.
+type ToolCallStore interface {
+	// Set stores call under its id.
+	Set(call StoredToolCall) error
+	// Get returns the call stored under id. A missing or expired call is
+	// reported as not found, not as error.
+	Get(id string) (StoredToolCall, bool, error)
+}
+
+// WithToolCallStore sets the store for tool calls generated by the chat
+// handler, an in-memory store with [DefaultToolCallTTL] by default.
+func WithToolCallStore(store ToolCallStore) ChatOption {
+	return func(c *chatConfig) {
+		c.toolCalls = store
+	}
+}
+
+// MemoryToolCallStore keeps tool calls in process memory.
+type MemoryToolCallStore struct {
+	ttl   time.Duration
+	mutex sync.Mutex
+	calls map[string]StoredToolCall
+}
+
+// NewMemoryToolCallStore creates a store keeping tool calls for ttl.
+func NewMemoryToolCallStore(ttl time.Duration) *MemoryToolCallStore {
+	s := &MemoryToolCallStore{
+		ttl:   ttl,
+		calls: make(map[string]StoredToolCall),
+	}
+	go s.cleanupExpiredCalls()
+	return s
+}
+
+func (s *MemoryToolCallStore) Set(call StoredToolCall) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls[call.Id] = call
+	return nil
+}
+
+func (s *MemoryToolCallStore) Get(id string) (StoredToolCall, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	call, exists := s.calls[id]
+	if !exists || s.expired(call) {
+		return StoredToolCall{}, false, nil
+	}
+	return call, true, nil
+}
+
+func (s *MemoryToolCallStore) expired(call StoredToolCall) bool {
+	return time.Since(call.Created) > s.ttl
+}
+
+// cleanupExpiredCalls periodically removes expired calls
+func (s *MemoryToolCallStore) cleanupExpiredCalls() {
+	for {
+		time.Sleep(time.Minute * 10)
+		s.mutex.Lock()
+		for id, call := range s.calls {
+			if s.expired(call) {
+				delete(s.calls, id)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// FileToolCallStore keeps each tool call as JSON file in a directory, which
+// survives restarts and can be shared by replicas, e.g. on a shared volume.
+type FileToolCallStore struct {
+	dir string
+	ttl time.Duration
+}
+
+// NewFileToolCallStore creates a store keeping tool calls for ttl in dir,
+// which is created if it does not exist.
+func NewFileToolCallStore(dir string, ttl time.Duration) (*FileToolCallStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &FileToolCallStore{dir: dir, ttl: ttl}
+	go s.cleanupExpiredCalls()
+	return s, nil
+}
+
+// path returns the file of the call with id. Ids are sent by clients, so
+// they are hashed instead of being used as file names.
+func (s *FileToolCallStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *FileToolCallStore) Set(call StoredToolCall) error {
+	data, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so readers never see partial calls
+	f, err := os.CreateTemp(s.dir, ".toolcall-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path(call.Id))
+}
+
+func (s *FileToolCallStore) Get(id string) (StoredToolCall, bool, error) {
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return StoredToolCall{}, false, nil
+	}
+	if err != nil {
+		return StoredToolCall{}, false, err
+	}
+	var call StoredToolCall
+	if err := json.Unmarshal(data, &call); err != nil {
+		return StoredToolCall{}, false, err
+	}
+	if time.Since(call.Created) > s.ttl {
+		return StoredToolCall{}, false, nil
+	}
+	return call, true, nil
+}
+
+// cleanupExpiredCalls periodically removes the files of expired calls
+func (s *FileToolCallStore) cleanupExpiredCalls() {
+	for {
+		time.Sleep(time.Minute * 10)
+		entries, err := os.ReadDir(s.dir)
+		if err != nil {
+			slog.Warn("Error reading tool call store", "dir", s.dir, "error", err)
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".json") {
+				continue
+			}
+			info, err := entry.Info()
+			if err == nil && time.Since(info.ModTime()) > s.ttl {
+				os.Remove(filepath.Join(s.dir, entry.Name()))
+			}
+		}
+	}
+}
+
+// getOwnedToolCall returns the call stored under id, if it belongs to owner.
+// Calls of other owners are reported as not found.
+func getOwnedToolCall(
+	l *slog.Logger,
+	toolCalls ToolCallStore,
+	id string,
+	owner ToolCallOwner,
+) (StoredToolCall, bool) {
+	call, ok, err := toolCalls.Get(id)
+	if err != nil {
+		l.Warn("Error reading tool call", "id", id, "error", err)
+	}
+	if ok && call.Owner != owner {
+		l.Warn("Tool call of another owner requested", "id", id)
+		return StoredToolCall{}, false
+	}
+	return call, ok
+}
+
+// lastTools returns the names of the tools whose results conclude msgs.
+func lastTools(
+	l *slog.Logger,
+	msgs []openai.Message,
+	toolCalls ToolCallStore,
+	owner ToolCallOwner,
+) []string {
+	var names []string
+	for i := len(msgs) - 1; i >= 0 && msgs[i].Role == "tool"; i-- {
+		if msgs[i].ToolCallID == nil {
+			continue
+		}
+		if call, ok := getOwnedToolCall(l, toolCalls, *msgs[i].ToolCallID, owner); ok {
+			names = append(names, call.Name)
+		}
+	}
+	return names
+}
+
+// restoreToolCalls completes the tool calls of msgs from the calls of owner
+// in toolCalls, so the prompt shows which call each tool result answers. Tool
+// calls clients returned without name or arguments are filled in, and tool
+// results without an assistant message requesting them get one inserted.
+func restoreToolCalls(
+	l *slog.Logger,
+	msgs []openai.Message,
+	toolCalls ToolCallStore,
+	owner ToolCallOwner,
+) []openai.Message {
+	get := func(id string) (StoredToolCall, bool) {
+		return getOwnedToolCall(l, toolCalls, id, owner)
+	}
+	requested := map[string]bool{}
+	restored := make([]openai.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.Role == "assistant" && msg.ToolCalls != nil {
+			calls := make([]openai.ToolCall, len(*msg.ToolCalls))
+			copy(calls, *msg.ToolCalls)
+			for i, tc := range calls {
+				requested[tc.Id] = true
+				if tc.Function.Name != "" && tc.Function.Arguments != "" {
+					continue
+				}
+				if call, ok := get(tc.Id); ok {
+					calls[i].Type = "function"
+					calls[i].Function = openai.ChatCompletionFunction{
+						Name: call.Name, Arguments: call.Arguments}
+				}
+			}
+			msg.ToolCalls = &calls
+		}
+		if msg.Role == "tool" && msg.ToolCallID != nil && !requested[*msg.ToolCallID] {
+			if call, ok := get(*msg.ToolCallID); ok {
+				requested[call.Id] = true
+				restored = append(restored, openai.Message{
+					Role: "assistant",
+					ToolCalls: &[]openai.ToolCall{{
+						Id:   call.Id,
+						Type: "function",
+						Function: openai.ChatCompletionFunction{
+							Name: call.Name, Arguments: call.Arguments},
+					}},
+				})
+			}
+		}
+		restored = append(restored, msg)
+	}
+	return restored
+}
@@ -0,0 +1,115 @@
+package llamacpp
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
+)
+
+func TestFileToolCallStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileToolCallStore(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+	call := StoredToolCall{
+		Id:        "../call-1",
+		Name:      "weather",
+		Arguments: `{"city":"Berlin"}`,
+		Model:     "mistral",
+		Owner:     ToolCallOwner{TokenID: 1, UserID: "alice"},
+		Created:   time.Now().Truncate(time.Second),
+	}
+	if err := store.Set(call); err != nil {
+		t.Fatalf("storing call: %v", err)
+	}
+	expired := StoredToolCall{Id: "call-2", Name: "weather", Created: time.Now().Add(-2 * time.Hour)}
+	if err := store.Set(expired); err != nil {
+		t.Fatalf("storing call: %v", err)
+	}
+
+	// a second store on the same directory, e.g. after a restart
+	restarted, err := NewFileToolCallStore(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+	got, ok, err := restarted.Get(call.Id)
+	if err != nil || !ok {
+		t.Fatalf("expected call %s; got ok %v, error %v", call.Id, ok, err)
+	}
+	if !got.Created.Equal(call.Created) {
+		t.Errorf("expected created %v; got %v", call.Created, got.Created)
+	}
+	got.Created = call.Created
+	if got != call {
+		t.Errorf("expected call %+v; got %+v", call, got)
+	}
+	if _, ok, err := restarted.Get(expired.Id); ok || err != nil {
+		t.Errorf("expected expired call to be missing; got ok %v, error %v", ok, err)
+	}
+	if _, ok, err := restarted.Get("unknown"); ok || err != nil {
+		t.Errorf("expected unknown call to be missing; got ok %v, error %v", ok, err)
+	}
+}
+
+func TestRestoreToolCalls(t *testing.T) {
+	store := NewMemoryToolCallStore(time.Hour)
+	owner := ToolCallOwner{TokenID: 1, UserID: "alice"}
+	for _, call := range []StoredToolCall{
+		{Id: "a", Name: "weather", Arguments: `{"city":"Berlin"}`, Owner: owner, Created: time.Now()},
+		{Id: "b", Name: "time", Arguments: `{}`, Owner: owner, Created: time.Now()},
+	} {
+		store.Set(call)
+	}
+	id := func(s string) *string { return &s }
+	msgs := []openai.Message{
+		{Role: "user", Content: "weather in Berlin?"},
+		{Role: "assistant", ToolCalls: &[]openai.ToolCall{{Id: "a"}}},
+		{Role: "tool", Content: "sunny", ToolCallID: id("a")},
+		{Role: "tool", Content: "12:00", ToolCallID: id("b")},
+	}
+	restored := restoreToolCalls(slog.Default(), msgs, store, owner)
+	if len(restored) != 5 {
+		t.Fatalf("expected 5 messages; got %d", len(restored))
+	}
+	if fn := (*restored[1].ToolCalls)[0].Function; fn.Name != "weather" || fn.Arguments != `{"city":"Berlin"}` {
+		t.Errorf("expected restored weather call; got %+v", fn)
+	}
+	if (*msgs[1].ToolCalls)[0].Function.Name != "" {
+		t.Errorf("expected the request's messages to be unchanged")
+	}
+	if restored[3].Role != "assistant" || (*restored[3].ToolCalls)[0].Function.Name != "time" {
+		t.Errorf("expected inserted time call before its result; got %+v", restored[3])
+	}
+
+	names := lastTools(slog.Default(), msgs, store, owner)
+	if len(names) != 2 || names[0] != "time" || names[1] != "weather" {
+		t.Errorf("expected last tools [time weather]; got %v", names)
+	}
+
+	// calls of other tokens are not disclosed
+	other := ToolCallOwner{TokenID: 2, UserID: "mallory"}
+	if restored := restoreToolCalls(slog.Default(), msgs, store, other); len(restored) != len(msgs) ||
+		(*restored[1].ToolCalls)[0].Function.Name != "" {
+		t.Errorf("expected no calls restored for another owner; got %+v", restored)
+	}
+	if names := lastTools(slog.Default(), msgs, store, other); len(names) != 0 {
+		t.Errorf("expected no last tools for another owner; got %v", names)
+	}
+}
+
+func TestNewToolCallId(t *testing.T) {
+	a, b := newToolCallId(), newToolCallId()
+	if len(a) != 9 || len(b) != 9 || a == b {
+		t.Errorf("expected distinct random ids of nine characters; got %s and %s", a, b)
+	}
+	for _, c := range a + b {
+		if !strings.ContainsRune(toolCallIdChars, c) {
+			t.Errorf("expected alphanumeric ids; got %s and %s", a, b)
+			break
+		}
+	}
+}
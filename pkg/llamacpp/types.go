@@ -27,10 +27,9 @@ type Request struct {
 	Seed             *int         `json:"seed,omitempty"`
 	Slot             int          `json:"id_slot"`
 	CachePrompt      bool         `json:"cache_prompt"`
-	LogitBias        [][2]float64 `json:"logit_bias"`
-	// TODO: logit_bias
-	// TODO: n_probs
-	// TODO: image_data
+	LogitBias        [][2]float64 `json:"logit_bias,omitempty"`
+	NProbs           int          `json:"n_probs,omitempty"`
+	ImageData        []ImageData  `json:"image_data,omitempty"`
 	// ignore_eos omitted
 	// system_prompt omitted
 }
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/discovertomorrow/progai-middleware/pkg/logging"
+	"github.com/discovertomorrow/progai-middleware/pkg/openai"
 	"github.com/discovertomorrow/progai-middleware/pkg/usage"
 )
 
@@ -17,8 +18,12 @@ func NewLlamacppUsageUpdater() *LlamacppUsageUpdater {
 	return &LlamacppUsageUpdater{}
 }
 
+// LlamaRequest are the fields of llama.cpp completion and OpenAI chat
+// requests usage is taken from.
 type LlamaRequest struct {
-	Prompt string `json:"prompt"`
+	Prompt    string           `json:"prompt"`
+	ImageData []ImageData      `json:"image_data"`
+	Messages  []openai.Message `json:"messages"`
 }
 
 type LlamaResponse struct {
@@ -49,6 +54,7 @@ func (u *LlamacppUsageUpdater) UsageFromInput(
 	}
 	return &usage.Usage{
 		InputBytes: len(r.Prompt),
+		Images:     len(r.ImageData) + countImages(r.Messages),
 	}
 }
 
@@ -0,0 +1,33 @@
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorResponse is the body of an OpenAI API error.
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+type Error struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// WriteError writes an OpenAI API compatible error response. param and code
+// are omitted (null) if empty.
+func WriteError(w http.ResponseWriter, status int, message, errType, param, code string) {
+	e := Error{Message: message, Type: errType}
+	if param != "" {
+		e.Param = &param
+	}
+	if code != "" {
+		e.Code = &code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: e})
+}
@@ -0,0 +1,56 @@
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/discovertomorrow/progai-middleware/pkg/logging"
+	"github.com/discovertomorrow/progai-middleware/pkg/session"
+)
+
+// Model is an entry of the OpenAI model list.
+type Model struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+	// Root is the canonical name of a model listed under an alias. Sessions
+	// allowing the canonical name allow the alias, as for chat requests.
+	Root string `json:"-"`
+}
+
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+// NewModelsHandler serves GET /v1/models in the OpenAI list format with the
+// models returned by listModels. If filterBySession is set, only models the
+// caller's session.SessionData allows, by their id or root, are listed.
+func NewModelsHandler(
+	listModels func() []Model,
+	filterBySession bool,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		l := logging.FromContext(ctx).With("function", "openai.<models handler>")
+
+		s, hasSession := session.FromContext(ctx)
+		list := ModelList{Object: "list", Data: []Model{}}
+		for _, m := range listModels() {
+			if filterBySession && hasSession &&
+				!s.ModelAllowed(m.Id) && (m.Root == "" || !s.ModelAllowed(m.Root)) {
+				continue
+			}
+			if m.Object == "" {
+				m.Object = "model"
+			}
+			list.Data = append(list.Data, m)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			l.Info("Error writing models", "error", err)
+		}
+	})
+}
@@ -78,8 +78,8 @@ func NewOpenAiChatHandler(
 		)
 
 		if err != nil {
-			l.Info("Error handeling request", err)
-			http.Error(w, "Error handeling request", http.StatusInternalServerError)
+			l.Info("Error handeling request", "error", err)
+			handler.WriteBackendError(w, err)
 			return
 		}
 		l.Info("Finished Response")
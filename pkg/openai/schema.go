@@ -0,0 +1,153 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Parameters is the JSON Schema of a function's parameters.
+type Parameters = Schema
+
+// Property is the JSON Schema of a single function parameter.
+type Property = Schema
+
+// Schema is a JSON Schema. Keywords without a field are kept in Extra, so a
+// schema survives a decode/encode round-trip unchanged. A boolean schema
+// (true or false) is represented by Bool.
+type Schema struct {
+	Type        SchemaType      `json:"type,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Enum        []interface{}   `json:"enum,omitempty"`
+	Const       json.RawMessage `json:"const,omitempty"`
+	Default     json.RawMessage `json:"default,omitempty"`
+
+	Properties           map[string]Schema `json:"properties,omitempty"`
+	Required             []string          `json:"required,omitempty"`
+	AdditionalProperties *Schema           `json:"additionalProperties,omitempty"`
+	Items                *Schema           `json:"items,omitempty"`
+
+	AnyOf []Schema `json:"anyOf,omitempty"`
+	OneOf []Schema `json:"oneOf,omitempty"`
+	AllOf []Schema `json:"allOf,omitempty"`
+
+	Minimum   *float64 `json:"minimum,omitempty"`
+	Maximum   *float64 `json:"maximum,omitempty"`
+	MinLength *int     `json:"minLength,omitempty"`
+	MaxLength *int     `json:"maxLength,omitempty"`
+	MinItems  *int     `json:"minItems,omitempty"`
+	MaxItems  *int     `json:"maxItems,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Format    string   `json:"format,omitempty"`
+
+	Bool  *bool                      `json:"-"`
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// schemaFields avoids recursion into Schema's JSON methods.
+type schemaFields Schema
+
+// schemaKeywords are the keywords with a field in Schema.
+var schemaKeywords = func() map[string]bool {
+	keywords := make(map[string]bool)
+	t := reflect.TypeOf(Schema{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			keywords[name] = true
+		}
+	}
+	return keywords
+}()
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		// null is no schema, not the boolean schema false
+		*s = Schema{}
+		return nil
+	}
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		*s = Schema{Bool: &b}
+		return nil
+	}
+	var fields schemaFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for k, v := range all {
+		if schemaKeywords[k] {
+			continue
+		}
+		if fields.Extra == nil {
+			fields.Extra = make(map[string]json.RawMessage)
+		}
+		fields.Extra[k] = v
+	}
+	*s = Schema(fields)
+	return nil
+}
+
+func (s Schema) MarshalJSON() ([]byte, error) {
+	if s.Bool != nil {
+		return json.Marshal(*s.Bool)
+	}
+	data, err := json.Marshal(schemaFields(s))
+	if err != nil || len(s.Extra) == 0 {
+		return data, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for k, v := range s.Extra {
+		all[k] = v
+	}
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(all); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// SchemaType is the type keyword of a [Schema], a single type or a list of
+// types.
+type SchemaType []string
+
+// Is reports whether t allows the type name.
+func (t SchemaType) Is(name string) bool {
+	for _, n := range t {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SchemaType) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = SchemaType{s}
+		return nil
+	}
+	var types []string
+	if err := json.Unmarshal(data, &types); err != nil {
+		return err
+	}
+	*t = types
+	return nil
+}
+
+func (t SchemaType) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
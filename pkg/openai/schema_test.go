@@ -0,0 +1,84 @@
+package openai
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSchemaRoundTrip(t *testing.T) {
+	input := `{"$defs":{"unit":{"enum":["m","ft"]}},"additionalProperties":false,` +
+		`"properties":{"height":{"exclusiveMinimum":0,"type":["number","null"]},` +
+		`"tags":{"items":{"type":"string","x-custom":{"a":1}},"type":"array"}},` +
+		`"required":["height"],"type":"object"}`
+
+	var s Schema
+	if err := json.Unmarshal([]byte(input), &s); err != nil {
+		t.Fatalf("decoding schema: %v", err)
+	}
+	if !s.Properties["height"].Type.Is("null") || s.AdditionalProperties.Bool == nil {
+		t.Errorf("unexpected schema %+v", s)
+	}
+	if _, ok := s.Properties["tags"].Items.Extra["x-custom"]; !ok {
+		t.Errorf("expected unknown keyword in Extra")
+	}
+
+	output, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("encoding schema: %v", err)
+	}
+	var expected, got interface{}
+	json.Unmarshal([]byte(input), &expected)
+	json.Unmarshal(output, &got)
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected round-trip\n%s\ngot\n%s", input, output)
+	}
+}
+
+func TestSchemaNull(t *testing.T) {
+	var fn Function
+	if err := json.Unmarshal([]byte(`{"name": "now", "parameters": null}`), &fn); err != nil {
+		t.Fatalf("decoding function: %v", err)
+	}
+	if fn.Parameters.Bool != nil {
+		t.Errorf("expected null parameters not to be the boolean schema %v", *fn.Parameters.Bool)
+	}
+	output, err := json.Marshal(fn.Parameters)
+	if err != nil {
+		t.Fatalf("encoding schema: %v", err)
+	}
+	if string(output) != "{}" {
+		t.Errorf("expected empty schema; got %s", output)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	var s Schema
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false
+	}`), &s); err != nil {
+		t.Fatalf("decoding schema: %v", err)
+	}
+	for input, valid := range map[string]bool{
+		`{"name": "Ada", "age": 36}`:                     true,
+		`{"name": "Ada", "age": 36, "tags": ["a", "b"]}`: true,
+		`{"name": "Ada"}`:                                false,
+		`{"name": "", "age": 36}`:                        false,
+		`{"name": "Ada", "age": 36.5}`:                   false,
+		`{"name": "Ada", "age": -1}`:                     false,
+		`{"name": "Ada", "age": 36, "tags": ["c"]}`:      false,
+		`{"name": "Ada", "age": 36, "other": 1}`:         false,
+		`{"name": "Ada", "age": 36`:                      false,
+	} {
+		if err := s.Validate([]byte(input)); (err == nil) != valid {
+			t.Errorf("expected valid=%v for %s; got %v", valid, input, err)
+		}
+	}
+}
@@ -9,15 +9,70 @@ import (
 // OpenAI
 
 type ChatRequest struct {
-	Messages      []Message      `json:"messages"`
-	Tools         []Tool         `json:"tools"`
-	ToolChoice    string         `json:"tool_choice"`
-	Model         string         `json:"model"`
-	Stream        bool           `json:"stream"`
-	MaxTokens     int            `json:"max_tokens"`
-	Temperature   *float32       `json:"temperature"`
-	TopP          *float32       `json:"top_p"`
-	StreamOptions *StreamOptions `json:"stream_options"`
+	Messages   []Message  `json:"messages"`
+	Tools      []Tool     `json:"tools"`
+	ToolChoice ToolChoice `json:"tool_choice"`
+	// ParallelToolCalls allows several tool calls in one message, defaults to
+	// true.
+	ParallelToolCalls *bool  `json:"parallel_tool_calls,omitempty"`
+	Model             string `json:"model"`
+	Stream            bool   `json:"stream"`
+	MaxTokens         int    `json:"max_tokens"`
+	// MaxCompletionTokens replaces MaxTokens in newer clients.
+	MaxCompletionTokens int            `json:"max_completion_tokens,omitempty"`
+	Temperature         *float32       `json:"temperature"`
+	TopP                *float32       `json:"top_p"`
+	StreamOptions       *StreamOptions `json:"stream_options"`
+	Stop                Stop           `json:"stop,omitempty"`
+	Seed                *int           `json:"seed,omitempty"`
+	PresencePenalty     *float32       `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float32       `json:"frequency_penalty,omitempty"`
+	// LogitBias maps token ids to a bias between -100 and 100.
+	LogitBias   map[string]float64 `json:"logit_bias,omitempty"`
+	N           *int               `json:"n,omitempty"`
+	User        string             `json:"user,omitempty"`
+	Logprobs    bool               `json:"logprobs,omitempty"`
+	TopLogprobs *int               `json:"top_logprobs,omitempty"`
+	// ResponseFormat constrains the output to JSON, optionally matching a
+	// schema.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormat is "text", "json_object" or, with JSONSchema,
+// "json_schema".
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema,omitempty"`
+	// Strict requires the output to match Schema.
+	Strict bool `json:"strict,omitempty"`
+}
+
+// Stop are the stop sequences of a request, given as a single string or an
+// array of strings.
+type Stop []string
+
+// UnmarshalJSON accepts a string, an array of strings and null.
+func (s *Stop) UnmarshalJSON(data []byte) error {
+	var single *string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = nil
+		if single != nil {
+			*s = Stop{*single}
+		}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return errors.New("stop is neither a string nor an array of strings")
+	}
+	*s = multiple
+	return nil
 }
 
 type StreamOptions map[string]interface{}
@@ -28,6 +83,53 @@ type Message struct {
 	Name       *string     `json:"name"`
 	ToolCallID *string     `json:"tool_call_id"`
 	ToolCalls  *[]ToolCall `json:"tool_calls"`
+	// Parts are the blocks of content given as an array, kept if it contains
+	// images. Content holds their text.
+	Parts []ContentPart `json:"-"`
+}
+
+// ContentPart is a block of content given as an array.
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	// URL of the image, or its data as base64 data URL.
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// UnmarshalJSON decodes a message, keeping the blocks of content with images
+// in Parts.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+	var decoded struct {
+		message
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*m = Message(decoded.message)
+	if len(decoded.Content) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(decoded.Content, &m.Content); err != nil {
+		return err
+	}
+	var parts []ContentPart
+	if err := json.Unmarshal(decoded.Content, &parts); err != nil {
+		return nil
+	}
+	for _, p := range parts {
+		if p.Type == "image_url" && p.ImageURL != nil {
+			m.Parts = parts
+			break
+		}
+	}
+	return nil
 }
 
 // Content is effectively a string in Go, but we give it a custom
@@ -69,6 +171,53 @@ func (c *Content) UnmarshalJSON(data []byte) error {
 	return errors.New("content is neither a string nor an array of text blocks")
 }
 
+// ToolChoice is either one of the modes "none", "auto" and "required" or,
+// in its object form {"type": "function", "function": {"name": ...}}, a
+// specific function the model has to call.
+type ToolChoice struct {
+	Mode     string // "none", "auto", "required" or "function"
+	Function string // name of the function, if Mode is "function"
+}
+
+// UnmarshalJSON accepts the string and the object form of tool_choice.
+func (tc *ToolChoice) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		*tc = ToolChoice{Mode: mode}
+		return nil
+	}
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil {
+		return errors.New("tool_choice is neither a string nor a function object")
+	}
+	if named.Type != "function" || named.Function.Name == "" {
+		return errors.New("tool_choice object must name a function")
+	}
+	*tc = ToolChoice{Mode: "function", Function: named.Function.Name}
+	return nil
+}
+
+// MarshalJSON writes the object form for a specific function, the mode
+// otherwise.
+func (tc ToolChoice) MarshalJSON() ([]byte, error) {
+	if tc.Mode != "function" {
+		if tc.Mode == "" {
+			return []byte("null"), nil
+		}
+		return json.Marshal(tc.Mode)
+	}
+	named := map[string]interface{}{
+		"type":     "function",
+		"function": map[string]string{"name": tc.Function},
+	}
+	return json.Marshal(named)
+}
+
 type Tool struct {
 	Type     string   `json:"type"`
 	Function Function `json:"function"`
@@ -80,18 +229,6 @@ type Function struct {
 	Parameters  Parameters `json:"parameters"`
 }
 
-type Parameters struct {
-	Type       string              `json:"type"`
-	Required   []string            `json:"required"`
-	Properties map[string]Property `json:"properties"`
-}
-
-type Property struct {
-	Type        string   `json:"type"`
-	Description string   `json:"description"`
-	Enum        []string `json:"enum"`
-}
-
 type StreamChatResponseWithUsage struct {
 	StreamChatResponse
 	Usage *ChatResponseUsage `json:"usage"`
@@ -109,7 +246,7 @@ type StreamChatResponse struct {
 type StreamChatResponseChoice struct {
 	Index        int         `json:"index"`
 	Delta        interface{} `json:"delta"`
-	Logprobs     *string     `json:"logprobs"`
+	Logprobs     *Logprobs   `json:"logprobs"`
 	FinishReason *string     `json:"finish_reason"`
 }
 
@@ -128,14 +265,39 @@ type ChatResponse struct {
 type ChatResponseChoice struct {
 	Index        int                   `json:"index"`
 	Message      ChatCompletionMessage `json:"message"`
-	Logprobs     *string               `json:"logprobs"`
+	Logprobs     *Logprobs             `json:"logprobs"`
 	FinishReason *string               `json:"finish_reason"`
 }
 
+// Logprobs are the log probabilities of the tokens of a choice's content.
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+// TokenLogprob is the log probability of a token and, with top_logprobs, of
+// the most likely tokens at its position.
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
 type ChatResponseUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                  `json:"prompt_tokens"`
+	CompletionTokens    int                  `json:"completion_tokens"`
+	TotalTokens         int                  `json:"total_tokens"`
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
 }
 
 type ChatCompletionMessage struct {
@@ -154,3 +316,24 @@ type ChatCompletionFunction struct {
 	Name      string `json:"name"`
 	Arguments string `json:"arguments"`
 }
+
+// ChatCompletionDelta is the delta of a streamed chat completion chunk.
+type ChatCompletionDelta struct {
+	Role      string          `json:"role,omitempty"`
+	Content   *string         `json:"content,omitempty"`
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+// ToolCallDelta is a streamed part of the tool call at Index. Only the first
+// part of a tool call carries its Id, Type and function name.
+type ToolCallDelta struct {
+	Index    int                         `json:"index"`
+	Id       string                      `json:"id,omitempty"`
+	Type     string                      `json:"type,omitempty"`
+	Function ChatCompletionFunctionDelta `json:"function"`
+}
+
+type ChatCompletionFunctionDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
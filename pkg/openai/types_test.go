@@ -0,0 +1,68 @@
+package openai
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestToolChoice(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected ToolChoice
+	}{
+		{`{"tool_choice": "required"}`, ToolChoice{Mode: "required"}},
+		{`{"tool_choice": {"type": "function", "function": {"name": "weather"}}}`, ToolChoice{Mode: "function", Function: "weather"}},
+		{`{}`, ToolChoice{}},
+	} {
+		var req ChatRequest
+		if err := json.Unmarshal([]byte(tc.input), &req); err != nil {
+			t.Fatalf("decoding %s: %v", tc.input, err)
+		}
+		if req.ToolChoice != tc.expected {
+			t.Errorf("expected %+v for %s; got %+v", tc.expected, tc.input, req.ToolChoice)
+		}
+		data, err := json.Marshal(req.ToolChoice)
+		if err != nil {
+			t.Fatalf("encoding %+v: %v", req.ToolChoice, err)
+		}
+		var decoded ToolChoice
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("decoding %s: %v", data, err)
+		}
+		if decoded != tc.expected {
+			t.Errorf("expected %+v after round trip; got %+v", tc.expected, decoded)
+		}
+	}
+
+	var req ChatRequest
+	if err := json.Unmarshal([]byte(`{"tool_choice": {"type": "function"}}`), &req); err == nil {
+		t.Errorf("expected an error for a tool_choice without function name")
+	}
+}
+
+func TestStop(t *testing.T) {
+	for input, expected := range map[string]Stop{
+		`{"stop": "\n"}`:            {"\n"},
+		`{"stop": ["a", "b"]}`:      {"a", "b"},
+		`{"stop": null}`:            nil,
+		`{"model": "without stop"}`: nil,
+	} {
+		var req ChatRequest
+		if err := json.Unmarshal([]byte(input), &req); err != nil {
+			t.Fatalf("decoding %s: %v", input, err)
+		}
+		if len(req.Stop) != len(expected) {
+			t.Fatalf("expected %q for %s; got %q", expected, input, req.Stop)
+		}
+		for i := range expected {
+			if req.Stop[i] != expected[i] {
+				t.Errorf("expected %q for %s; got %q", expected, input, req.Stop)
+			}
+		}
+	}
+
+	var req ChatRequest
+	if err := json.Unmarshal([]byte(`{"stop": 1}`), &req); err == nil {
+		t.Errorf("expected an error for a numeric stop")
+	}
+}
@@ -0,0 +1,206 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+// Validate reports whether data is a JSON value matching s. Keywords kept in
+// Extra, like $ref and format, are not validated.
+func (s Schema) Validate(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("invalid JSON: data after the value")
+	}
+	return s.validate("$", v)
+}
+
+func (s Schema) validate(path string, v interface{}) error {
+	if s.Bool != nil {
+		if !*s.Bool {
+			return fmt.Errorf("%s: no value allowed", path)
+		}
+		return nil
+	}
+	if len(s.Type) > 0 && !s.Type.matches(v) {
+		return fmt.Errorf("%s: expected %s", path, typeList(s.Type))
+	}
+	if len(s.Const) > 0 && !jsonEqual(s.Const, v) {
+		return fmt.Errorf("%s: expected %s", path, s.Const)
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if data, err := json.Marshal(e); err == nil && jsonEqual(data, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", path)
+		}
+	}
+	for _, sub := range s.AllOf {
+		if err := sub.validate(path, v); err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 && countMatches(s.AnyOf, path, v) == 0 {
+		return fmt.Errorf("%s: value matches none of anyOf", path)
+	}
+	if len(s.OneOf) > 0 && countMatches(s.OneOf, path, v) != 1 {
+		return fmt.Errorf("%s: value matches not exactly one of oneOf", path)
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return s.validateObject(path, v)
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: expected at least %d items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: expected at most %d items", path, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: expected at least %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: expected at most %d characters", path, *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			// patterns RE2 cannot compile are not validated
+			if re, err := regexp.Compile(s.Pattern); err == nil && !re.MatchString(v) {
+				return fmt.Errorf("%s: expected to match %s", path, s.Pattern)
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: expected at least %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s: expected at most %v", path, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func (s Schema) validateObject(path string, v map[string]interface{}) error {
+	for _, key := range s.Required {
+		if _, ok := v[key]; !ok {
+			return fmt.Errorf("%s: missing property %s", path, key)
+		}
+	}
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if prop, ok := s.Properties[key]; ok {
+			if err := prop.validate(path+"."+key, v[key]); err != nil {
+				return err
+			}
+		} else if s.AdditionalProperties != nil {
+			if err := s.AdditionalProperties.validate(path+"."+key, v[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether v, decoded with json.Number, has one of the types.
+func (t SchemaType) matches(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return t.Is("null")
+	case bool:
+		return t.Is("boolean")
+	case string:
+		return t.Is("string")
+	case []interface{}:
+		return t.Is("array")
+	case map[string]interface{}:
+		return t.Is("object")
+	case json.Number:
+		if t.Is("number") {
+			return true
+		}
+		f, err := v.Float64()
+		return t.Is("integer") && err == nil && f == math.Trunc(f)
+	}
+	return false
+}
+
+func typeList(t SchemaType) string {
+	if len(t) == 1 {
+		return t[0]
+	}
+	return fmt.Sprintf("one of %v", []string(t))
+}
+
+func countMatches(schemas []Schema, path string, v interface{}) int {
+	n := 0
+	for _, s := range schemas {
+		if s.validate(path, v) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// jsonEqual reports whether the JSON value data equals v.
+func jsonEqual(data []byte, v interface{}) bool {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var expected interface{}
+	if err := dec.Decode(&expected); err != nil {
+		return false
+	}
+	a, errA := json.Marshal(normalizeNumbers(expected))
+	b, errB := json.Marshal(normalizeNumbers(v))
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
+
+// normalizeNumbers converts json.Number to float64, so 1 and 1.0 are equal.
+func normalizeNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i := range v {
+			normalized[i] = normalizeNumbers(v[i])
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for k := range v {
+			normalized[k] = normalizeNumbers(v[k])
+		}
+		return normalized
+	}
+	return v
+}
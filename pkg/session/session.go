@@ -3,6 +3,7 @@ package session
 import (
 	"context"
 	"net/http"
+	"slices"
 
 	"github.com/discovertomorrow/progai-middleware/pkg/logging"
 )
@@ -11,6 +12,24 @@ type SessionData struct {
 	TokenID               int
 	UserID                string
 	TokenConcurrencyLimit int
+	// Priority is the name of the class requests of this token wait in for a
+	// backend slot, e.g. "interactive", "batch" or "background". Empty uses
+	// the default class.
+	Priority string
+	// Weight is the share of backend slots the user gets relative to other
+	// waiting users of the same priority. Values < 1 are treated as 1.
+	Weight int
+	// AllowedModels restricts the models the token may use. Empty allows all
+	// models.
+	AllowedModels []string
+}
+
+// ModelAllowed reports whether the session may use model.
+func (s SessionData) ModelAllowed(model string) bool {
+	if len(s.AllowedModels) == 0 {
+		return true
+	}
+	return slices.Contains(s.AllowedModels, model)
 }
 
 type key int